@@ -0,0 +1,16 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package tokenmonster
+
+import (
+	"os"
+)
+
+// mmap is not available so the file is read into memory
+func mmapFile(filename string) ([]byte, error) {
+	return os.ReadFile(filename)
+}
+
+func munmapFile(b []byte) error {
+	return nil
+}
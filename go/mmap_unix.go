@@ -0,0 +1,29 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package tokenmonster
+
+import (
+	"os"
+	"syscall"
+)
+
+func mmapFile(filename string) ([]byte, error) {
+	fi, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+	stat, err := fi.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := stat.Size()
+	if size < mmapHeaderSize || int64(int(size)) != size {
+		return nil, ErrBadMagic
+	}
+	return syscall.Mmap(int(fi.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmapFile(b []byte) error {
+	return syscall.Munmap(b)
+}
@@ -5,14 +5,21 @@ import (
 	"io"
 	"bytes"
 	"unsafe"
+	"sync"
 	"errors"
+	"runtime"
+	"sort"
+	"io/fs"
 	"strings"
 	"strconv"
+	"math"
+	"math/rand"
 	"unicode"
 	"unicode/utf8"
 	"unicode/utf16"
 	"encoding/hex"
 	"encoding/binary"
+	"hash/crc32"
 	"gopkg.in/yaml.v3"
 	"github.com/AlasdairF/Custom"
 	"github.com/AlasdairF/Conv"
@@ -24,19 +31,38 @@ import (
 )
 
 const (
+	vocabMagic = "TMVB" // the first 4 bytes of a vocabulary saved with Save, vocabularies saved before the header was added begin with the capcode byte
+	vocabVersion = 1
+	mmapMagic = "TMVOCMAP" // the first 8 bytes of a vocabulary saved with SaveMmap
+	mmapVersion = 2
+	mmapHeaderSize = 64
+	mmapInfoSize = 24 // bytes per token in the info section
+	mmapDeletedSize = 16 // bytes per deleted token
 	minHighSurrogate = 0xD800 // Start of high surrogate range
 	maxHighSurrogate = 0xDBFF // End of high surrogate range
 	minLowSurrogate  = 0xDC00 // Start of low surrogate range
 	maxLowSurrogate  = 0xDFFF // End of low surrogate range
 	runeError = '\uFFFD'
 	DOES_NOT_EXIST = 16777215
+	normCollapse = 16 // norm.Normalizer flags
+	normTrim = 32
+	normLeadingSpace = 64
+	BoundaryToken = 0 // boundary policies for Chunk
+	BoundarySentence = 1
+	BoundaryParagraph = 2
 )
 
 var isLittleEndian = *(*byte)(unsafe.Pointer(&[]uint16{256}[0])) == 0
 
+var (
+	ErrBadMagic = errors.New(`Not a TokenMonster vocabulary file.`)
+	ErrChecksum = errors.New(`TokenMonster vocabulary file is corrupt, the checksum does not match.`)
+	ErrUnsupportedVersion = errors.New(`Unsupported version of TokenMonster vocabulary file.`)
+)
+
 // The main struct for the vocabulary
 type Vocab struct {
-	dictionary *pansearch.Fast
+	dictionary tokenLookup
 	info []tokenInfo
 	reverse [][]byte
 	deleted []deletedStruct // deleted tokens are stored here and can later be restored
@@ -50,6 +76,14 @@ type Vocab struct {
 	level uint8
 	reserve uint8
 	normalizer norm.Normalizer // uint8
+	mapping []byte // the memory mapped file if loaded with LoadMmap, in which case the vocabulary is read-only
+}
+
+// The dictionary of tokens, which is either a pansearch.Fast or the prebuilt lookup table of a memory mapped vocabulary.
+// The index returned is the index of the token in `info`.
+type tokenLookup interface {
+	LongestSubstring(key []byte) (uint32, int, bool)
+	Find(key []byte) (uint32, bool)
 }
 
 // A decoder object for sequential decoding.
@@ -60,6 +94,132 @@ type Decoder struct {
 	capcodeDecoder *capcode.Decoder
 }
 
+// An encoder object for tokenizing a stream of text from an io.Reader.
+// Use the NewEncoder function of the Vocab struct.
+type Encoder struct {
+	vocab Vocab
+	reader io.Reader
+	raw []byte // text read that has not yet been normalized
+	normalized []byte // normalized text that has not yet been tokenized
+	state streamState
+	missing int
+	started bool // the beginning of the stream has been normalized
+	eof bool
+	done bool
+}
+
+// The range of bytes [Start, End) in the original text that a token was produced from.
+type Offset struct {
+	Start	int
+	End		int
+}
+
+// Options for TokenizeWithOptions, given as the special tokens in their decoded form.
+// As with tiktoken, a list containing only "all" means all of the special tokens.
+type TokenizeOptions struct {
+	AllowSpecial	[]string	// special tokens that are always tokenized as that special token
+	DisallowSpecial	[]string	// special tokens that are an error if they occur in the text
+}
+
+// Options for TokenizeBatch and TokenizeBatchToSerialized.
+type BatchOptions struct {
+	Workers	int					// maximum number of texts tokenized at the same time, or 0 for the number of CPUs
+	Special	*TokenizeOptions	// if not nil, special tokens are handled as by TokenizeWithOptions
+}
+
+// A window of tokens from Chunk, and the range of bytes [Start, End) in the original text that it was produced from.
+type Chunk struct {
+	Tokens	[]uint32
+	Start	int
+	End		int
+}
+
+// A tokenization from TokenizeNBest and the sum of the scores of the branches chosen to produce it.
+// Missing is the number of characters for which there were no tokens and were replaced with Unk token.
+type Segmentation struct {
+	Tokens	[]uint32
+	Score	int
+	Missing	int
+}
+
+// The parts of the score of a branch in the ungreedy algorithm, see TokenizeTrace. Deductions are negative.
+type ScoreParts struct {
+	Length			int	// the total length of the branch
+	Types			int	// 1 point for each token being either all letters or all punctuation
+	WordBeginnings	int	// 1 less than the number of word beginnings in each token, min 0
+	BeginsSpace		int	// 1 if the second token begins with a space
+	SpaceAfter		int	// 1 if the next character after the second token is a space
+	WholeWords		int	// 100x the number of whole words covered by the branch
+	SplitWord		int	// -103 if the first and second token split a word
+	SplitCapcode	int	// -100 if the branch splits capcode markers from each other
+	EndsInWord		int	// -3 if the second token ends inside a word
+	ExtraToken		int	// -1 if the branch uses the delete token
+	Shorter			int	// -100 if an alternative branch is shorter than the longest first token
+	SameLength		int	// -10000 if an alternative branch is the same length as the longest first token
+}
+
+// One of the branches considered at a TraceStep.
+type TraceCandidate struct {
+	Branch	string		// "longest", "alternative1" or "alternative2", followed by "+delete" if the delete token is used
+	Tokens	[]uint32	// the tokens produced if this branch is chosen
+	Next	uint32		// the ID of the token looked ahead to after them
+	Score	int
+	Parts	ScoreParts
+}
+
+// A step of the ungreedy algorithm from TokenizeTrace, which produced Tokens at Position.
+type TraceStep struct {
+	Position	int			// the byte offset in the normalized text
+	Longest		uint32		// the ID of the longest token that matched at Position, or DOES_NOT_EXIST if there was none
+	AfterDelete	bool		// the previous step ended with the delete token, so Longest begins with a space that is not in the text
+	Candidates	[]TraceCandidate
+	Chosen		int			// the index of the chosen candidate, or -1 if Longest was used without comparing branches
+	Reason		string		// why there are no candidates
+	Tokens		[]uint32	// the tokens produced by this step
+	Missing		bool		// there was no token for the character at Position
+}
+
+type batchPart struct {
+	worker	int
+	start	int
+	end		int
+}
+
+type specialMatch struct {
+	text	[]byte
+	id		uint32
+	allow	bool
+}
+
+type streamState struct {
+	index	uint32	// index of the token chosen at the position where tokenizing stopped
+	length	int
+	forwardDelete int
+	pending	bool
+}
+
+type branch struct {
+	tokens	[2]uint32
+	nTokens	int
+	advance	int			// number of bytes the tokens cover
+	length	int			// length of the longest match at the new position
+	index	uint32		// index of the longest match at the new position
+	forwardDelete int
+	parts	ScoreParts
+	score	int
+}
+
+type nbestState struct {
+	tokens	[]uint32
+	i		int
+	length	int
+	index	uint32
+	forwardDelete int
+	score	int
+	missing	int
+	matched	bool		// length and index are the longest match at i
+}
+
 type tokenInfo struct {
 	alt		tokenOuter
 	token 	[]byte
@@ -146,46 +306,33 @@ func norm_UTF16_NFD(input []byte) ([]byte, error) {
 */
 
 // Returns the number of bytes at the end of the slice of bytes that are part of an incomplete UTF-8 sequence.
+// Bytes that can't become valid UTF-8 however many bytes follow them are not counted, so that they're not held back.
 func incompleteUTF8Bytes(bytes []byte) int {
     bytesLen := len(bytes)
-    // Single byte or empty string
-    if bytesLen == 0 {
+    if bytesLen == 0 || bytes[bytesLen-1]&0b10000000 == 0 {
         return 0
     }
-    if bytes[bytesLen-1]&0b10000000 == 0 {
-        return 0
-    }
-    // Find the start of the last character sequence
+    // Find the start of the last character sequence, which is no more than 4 bytes long
     seqStart := bytesLen - 1
-    for seqStart >= 0 && (bytes[seqStart]&0b11000000) == 0b10000000 {
+    for seqStart > 0 && seqStart > bytesLen-4 && (bytes[seqStart]&0b11000000) == 0b10000000 {
         seqStart--
     }
-    // If no sequence start found, all bytes are continuation bytes and thus are all incomplete
-    if seqStart == -1 {
-        return bytesLen
-    }
     // Determine expected sequence length from leading byte
     firstByte := bytes[seqStart]
     var seqLen int
-    if (firstByte & 0b10000000) == 0 {
-        seqLen = 1
-    } else if (firstByte & 0b11100000) == 0b11000000 {
+    if (firstByte & 0b11100000) == 0b11000000 {
         seqLen = 2
     } else if (firstByte & 0b11110000) == 0b11100000 {
         seqLen = 3
     } else if (firstByte & 0b11111000) == 0b11110000 {
         seqLen = 4
     } else {
-        // This is not a valid UTF-8 starting byte
-        return bytesLen - seqStart
+        // ASCII or a continuation byte followed by continuation bytes, neither of which can be completed
+        return 0
     }
     // If sequence length is larger than the remaining bytes, it's incomplete
     if bytesLen-seqStart < seqLen {
-        return seqLen - (bytesLen - seqStart)
-    }
-    // If the sequence start byte was not the start of a multi-byte sequence, then the array is incomplete.
-    if seqLen == 1 && (bytes[seqStart] & 0b11000000) != 0 {
-        return bytesLen
+        return bytesLen - seqStart
     }
     return 0
 }
@@ -230,6 +377,47 @@ func convertStringToUTF16(s string) []byte {
 	*/
 }
 
+// Encodes a UTF-8 string as UTF-16 little-endian bytes.
+func encodeUTF16(s string) []byte {
+	b := make([]byte, 0, len(s) * 2)
+	for _, r := range s {
+		if r >= 0x10000 {
+			r1, r2 := utf16.EncodeRune(r)
+			b = append(b, byte(r1), byte(r1 >> 8), byte(r2), byte(r2 >> 8))
+		} else {
+			b = append(b, byte(r), byte(r >> 8))
+		}
+	}
+	return b
+}
+
+// Converts UTF-16 bytes to a UTF-8 string, they are little-endian unless they begin with a big-endian byte order mark.
+// A stray byte at the end is ignored, and unpaired surrogates become U+FFFD.
+func convertUTF16ToString(b []byte) string {
+	u := make([]uint16, len(b) / 2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(b[i * 2:])
+	}
+	return convertUint16sToString(u)
+}
+
+// Converts UTF-16 code units to a UTF-8 string, a byte order mark at the beginning is removed and if it's swapped then so are all of the code units.
+func convertUint16sToString(u []uint16) string {
+	if len(u) > 0 {
+		switch u[0] {
+			case 0xFEFF:
+				u = u[1:]
+			case 0xFFFE:
+				swapped := make([]uint16, len(u) - 1)
+				for i, v := range u[1:] {
+					swapped[i] = v << 8 | v >> 8
+				}
+				u = swapped
+		}
+	}
+	return string(utf16.Decode(u))
+}
+
 func applyCapcode(data []byte, usingCapcode uint8) []byte {
 	if usingCapcode == 2 {
 		return capcode.Encode(data)
@@ -284,6 +472,219 @@ func normalizeSafe(b []byte, usingCapcode uint8, normalizer norm.Normalizer) ([]
 	return normalizer.Normalize(b)
 }
 
+// Normalizes the same as normalize, and also returns for each byte of the result the range of bytes in data that it came from.
+// Unlike normalize, data is not modified.
+func normalizeWithOffsets(data []byte, usingCapcode uint8, charset uint8, normalizer norm.Normalizer) ([]byte, []Offset, error) {
+	processed, err := normalizer.Normalize(unleak(data))
+	if err == nil {
+		capcoded := applyCapcode(processed, usingCapcode)
+		return capcoded, composeOffsets(alignNormalized(data, processed, charset, normalizer), alignCapcode(processed, capcoded, charset, usingCapcode), len(data)), nil
+	} else if normalizer.SpecifiedLowercase() {
+		return processed, nil, err
+	}
+	// if failed try it the other way around
+	capcoded := applyCapcode(unleak(data), usingCapcode)
+	processed, err = normalizer.Normalize(unleak(capcoded))
+	if err != nil {
+		return processed, nil, err
+	}
+	return processed, composeOffsets(alignCapcode(data, capcoded, charset, usingCapcode), alignNormalized(capcoded, processed, charset, normalizer), len(data)), nil
+}
+
+// Matches the normalized text back to the original text one character at a time, by normalizing each character along with its combining marks.
+// Spaces that were collapsed or trimmed are skipped, and a leading space that was added belongs to no characters.
+func alignNormalized(original []byte, normalized []byte, charset uint8, normalizer norm.Normalizer) []Offset {
+	offsets := make([]Offset, len(normalized))
+	characterNormalizer := norm.Normalizer{Flag: normalizer.Flag &^ (normCollapse | normTrim | normLeadingSpace)}
+	space := []byte{' '}
+	if charset == 2 {
+		space = []byte{' ', 0}
+	}
+	var i, j, end, n, size int
+	var r rune
+	var piece, buf []byte
+	var err error
+	for i < len(original) && j < len(normalized) {
+		r, size = decodeRune(original[i:], charset)
+		end = i + branchless.Max(size, 1)
+		if r == '\r' { // \r\n is changed to \n by unixlines so keep them together
+			if r2, n2 := decodeRune(original[end:], charset); r2 == '\n' {
+				end += n2
+			}
+		}
+		for end < len(original) {
+			r2, n2 := decodeRune(original[end:], charset)
+			if n2 == 0 || !unicode.Is(unicode.Mn, r2) {
+				break
+			}
+			end += n2
+		}
+		piece = original[i:end]
+		if characterNormalizer.Flag != 0 {
+			buf = append(buf[:0], piece...)
+			if buf, err = characterNormalizer.Normalize(buf); err == nil {
+				piece = buf
+			}
+		}
+		switch {
+			case len(piece) > 0 && bytes.HasPrefix(normalized[j:], piece):
+				if bytes.Equal(piece, original[i:end]) { // unchanged so each byte is its own
+					for n = 0; n < len(piece); n++ {
+						offsets[j + n] = Offset{i + n, i + n + 1}
+					}
+					j += len(piece)
+					i = end
+					continue
+				}
+				n = j + len(piece)
+			case r <= 32: // whitespace that was collapsed or trimmed
+				i = end
+				continue
+			case j == 0 && normalizer.Flag & normLeadingSpace != 0 && bytes.HasPrefix(normalized, space):
+				for ; j < len(space); j++ {
+					offsets[j] = Offset{i, i}
+				}
+				continue
+			default: // unexpected, but keep going in step
+				n = j + branchless.Min(branchless.Max(len(piece), 1), len(normalized) - j)
+		}
+		for ; j < n; j++ {
+			offsets[j] = Offset{i, end}
+		}
+		i = end
+	}
+	for ; j < len(normalized); j++ {
+		offsets[j] = Offset{len(original), len(original)}
+	}
+	return offsets
+}
+
+// Matches the capcoded text back to the text before capcode was applied.
+// Inserted capcode markers belong to no characters.
+func alignCapcode(original []byte, capcoded []byte, charset uint8, usingCapcode uint8) []Offset {
+	offsets := make([]Offset, len(capcoded))
+	var i, j, n, size, size2 int
+	var r, r2 rune
+	for j < len(capcoded) {
+		r2, size2 = decodeRune(capcoded[j:], charset)
+		size2 = branchless.Max(size2, 1)
+		n = i
+		if i < len(original) {
+			r, size = decodeRune(original[i:], charset)
+			size = branchless.Max(size, 1)
+			// With capcode 2 uppercase letters are lowercased, so an uppercase letter can't be matched to itself
+			if r == r2 && size == size2 && (usingCapcode != 2 || unicode.ToLower(r) == r) { // unchanged so each byte is its own
+				for n = 0; n < size; n++ {
+					offsets[j + n] = Offset{i + n, i + n + 1}
+				}
+				i += size
+				j += size
+				continue
+			}
+			if usingCapcode == 2 && unicode.ToLower(r) == r2 {
+				n = i + size
+			}
+		}
+		for size2 += j; j < size2; j++ {
+			offsets[j] = Offset{i, n}
+		}
+		i = n
+	}
+	return offsets
+}
+
+// Converts offsets into the intermediate text to offsets into the original text.
+func composeOffsets(inner []Offset, outer []Offset, lenOriginal int) []Offset {
+	for k, o := range outer {
+		if o.Start < o.End {
+			outer[k] = Offset{inner[o.Start].Start, inner[o.End - 1].End}
+		} else if o.Start < len(inner) {
+			outer[k] = Offset{inner[o.Start].Start, inner[o.Start].Start}
+		} else {
+			outer[k] = Offset{lenOriginal, lenOriginal}
+		}
+	}
+	return outer
+}
+
+// Normalizes part of a text, `first` and `last` being whether it is the beginning and end of the whole text.
+// Trim and leading space apply only to the beginning and end of the whole text, so any other edge is guarded with a letter while normalizing.
+// The guards are removed afterwards, along with the leading space if it was added in front of the guard.
+func (vocab *Vocab) normalizeSegment(b []byte, first bool, last bool) ([]byte, error) {
+	if vocab.normalizer.Flag & (normTrim | normLeadingSpace) == 0 || (first && last) {
+		return normalize(b, vocab.usingCapcode, vocab.normalizer)
+	}
+	guard, space := []byte{'x'}, []byte{' '}
+	if vocab.charset == 2 {
+		guard, space = []byte{'x', 0}, []byte{' ', 0}
+	}
+	guarded := make([]byte, 0, len(b) + (len(guard) * 2))
+	if !first {
+		guarded = append(guarded, guard...)
+	}
+	guarded = append(guarded, b...)
+	if !last {
+		guarded = append(guarded, guard...)
+	}
+	processed, err := vocab.normalizer.Normalize(guarded)
+	if err != nil {
+		return nil, err
+	}
+	if !first {
+		if bytes.HasPrefix(processed, space) { // leading space was added before the guard
+			processed = processed[len(space):]
+		}
+		processed = processed[len(guard):]
+	}
+	if !last {
+		processed = processed[:len(processed) - len(guard)]
+	}
+	return applyCapcode(processed, vocab.usingCapcode), nil
+}
+
+func batchWorkers(workers int, numTexts int) int {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	return branchless.Max(branchless.Min(workers, numTexts), 1)
+}
+
+func sumBatch(list []int) int {
+	var total int
+	for _, v := range list {
+		total += v
+	}
+	return total
+}
+
+func firstError(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Appends the tokens to the buffer serialized with 16-bit, 24-bit or 32-bit encoded unsigned integers.
+func appendSerialized(buffer []byte, tokens []uint32, encodingLength uint8) []byte {
+	switch encodingLength {
+		case 2:
+			for _, v := range tokens {
+				buffer = append(buffer, uint8(v), uint8(v >> 8))
+			}
+		case 3:
+			for _, v := range tokens {
+				buffer = append(buffer, uint8(v), uint8(v >> 8), uint8(v >> 16))
+			}
+		case 4:
+			for _, v := range tokens {
+				buffer = append(buffer, uint8(v), uint8(v >> 8), uint8(v >> 16), uint8(v >> 24))
+			}
+	}
+	return buffer
+}
+
 func hasSuffixPos(ungreedySuffixesB [][]byte, key []byte, charset uint8, usingCapcode uint8) int {
 	for _, suffix := range ungreedySuffixesB {
 		if bytes.HasSuffix(key, suffix) {
@@ -435,6 +836,88 @@ func unleak(b []byte) []byte {
 	return new
 }
 
+// Returns the flag and number of words of a regular (not special) token, which type of character it begins with
+// (0 = space, 1 = letter, 2 = number, 3 = other) and the minimum length of the token's alternatives.
+func tokenFlags(token []byte, charset uint8, usingCapcode uint8) (uint8, uint8, int, int) {
+	var flag, nWords uint8
+	var begin int
+	var onlyLetterSpace, onlyNumberSpace, onlyPunc bool
+	minAltSize := 1
+	r, n := decodeRune(token, charset)
+	r2, n2 := decodeRune(token[n:], charset)
+	// Check beginning of token
+	if r == ' ' {
+		flag = 4
+		if isAlphaNum(r2, usingCapcode) {
+			nWords++
+			minAltSize = 2
+		}
+	} else if isLetter(r, usingCapcode) {
+		flag = 2
+		begin = 1
+	} else if isCapcode(r, usingCapcode) {
+		if r == capcode.CharacterToken || r == capcode.WordToken {
+			flag = 4 // count as a space
+		}
+		flag |= 16 // begins on capcode
+		begin = 3
+	} else if unicode.IsNumber(r) {
+		begin = 2
+	} else {
+		begin = 3
+	}
+	// Count words in token
+	if len(token) == 1 {
+		onlyPunc = true
+	} else {
+		if (r == ' ' || isLetter(r, usingCapcode)) && isLetter(r2, usingCapcode) {
+			onlyLetterSpace = true
+		} else if (r == ' ' || unicode.IsNumber(r)) && unicode.IsNumber(r2) {
+			onlyNumberSpace = true
+		} else if !isAlphaNum(r, usingCapcode) && !isAlphaNum(r2, usingCapcode) {
+			onlyPunc = true
+		}
+		for i := n + n2; i < len(token); i += n2 {
+			r = r2
+			r2, n2 = decodeRune(token[i:], charset)
+			if r == ' ' && isAlphaNum(r2, usingCapcode) {
+				nWords++
+			}
+			if isLetter(r2, usingCapcode) {
+				onlyPunc = false
+				onlyNumberSpace = false
+			} else if unicode.IsNumber(r2) {
+				onlyPunc = false
+				onlyLetterSpace = false
+			} else if r2 != ' ' {
+				onlyLetterSpace = false
+				onlyNumberSpace = false
+			}
+		}
+	}
+	// Now do some precalculations concerning the token
+	r = decodeLastRune(token, charset)
+	if minAltSize == 2 && isLetter(r, usingCapcode) && onlyLetterSpace { // only letters and full words
+		if nWords == 1 {
+			flag |= 32 // 1 word beginning space with only letters
+		}
+	}
+	if minAltSize == 2 && nWords <= 1 { // begins _A and more than 1 word
+		minAltSize = 1
+	}
+	if isCapcode(r, usingCapcode) {
+		flag |= 8
+	}
+	// Check end of token
+	if isLetter(r, usingCapcode) { // token ends with a letter
+		flag |= 1
+	}
+	if onlyLetterSpace || onlyNumberSpace || onlyPunc {
+		flag |= 128
+	}
+	return flag, nWords, begin, minAltSize
+}
+
 func canHaveUnkToken(i int, usingCapcode uint8) bool {
 	if (i < 256 && usingCapcode != 2) || i < 233 {
 		return true
@@ -453,6 +936,7 @@ func (vocab *Vocab) NewDecoder() *Decoder {
 
 // Flushes the remainder from the Decoder instance
 // These will any trailing incomplete UTF-8 sequences or capcode encoding marks
+// The output of every call to Decode followed by Flush is the same as decoding all of the tokens at once, and for a lossless vocabulary (see IsLossless) that is the original text.
 func (d *Decoder) Flush() []byte {
 	data := d.remainder
 	d.remainder = nil
@@ -795,6 +1279,26 @@ func (vocab *Vocab) Decode(tokens []uint32) []byte {
 	return data
 }
 
+// Decodes tokens back to a string.
+// For UTF-16 vocabularies the text is converted from UTF-16 to UTF-8.
+func (vocab *Vocab) DecodeToString(tokens []uint32) string {
+	data := vocab.decode(tokens)
+	if vocab.charset == 2 {
+		data = []byte(convertUTF16ToString(data))
+	}
+	if vocab.usingCapcode == 2 {
+		data = capcode.Decode(data)
+	} else if vocab.usingCapcode == 1 {
+		data = capcode.NoCapcodeDecode(data)
+	}
+	return string(data)
+}
+
+// Decodes tokens back to UTF-16 code units, for any charset.
+func (vocab *Vocab) DecodeToUTF16(tokens []uint32) []uint16 {
+	return utf16.Encode([]rune(vocab.DecodeToString(tokens)))
+}
+
 // Decodes tokens from a serialized bytes slice.
 // `encodingLength` must be one of: 0, 2, 3, 4.
 // If you enter `encodingLength` 0 then it will determine the encoding length from the vocabulary size.
@@ -964,7 +1468,209 @@ func (vocab *Vocab) Tokenize(data []byte) ([]uint32, int, error) {
 	if err != nil {
 		return nil, 0, err
 	}
-	return vocab.tokenize(normalized)
+	return vocab.tokenize(normalized, nil, nil)
+}
+
+// Tokenizes text from bytes slice to token IDs, choosing between the candidate branches at random instead of always choosing the best one, for subword regularization.
+// Each branch is chosen with probability proportional to exp((score - bestScore) / temperature). Scores are roughly 100 per whole word covered plus 1 per character,
+// so a temperature of around 1 to 10 varies how words are split, and around 100 or more also varies how words are grouped. A temperature of 0 or less is the same as Tokenize.
+// If `rng` is nil then a new random source is used. The same text tokenized with the same seed gives the same tokens.
+// The 2nd returned value (int) is the number of characters for which there were no tokens and were replaced with Unk token.
+func (vocab *Vocab) TokenizeSampled(data []byte, temperature float64, rng *rand.Rand) ([]uint32, int, error) {
+	if temperature <= 0 {
+		return vocab.Tokenize(data)
+	}
+	if vocab.maxTokenLength == 0 {
+		return []uint32{}, 0, nil
+	}
+	normalized, err := normalize(data, vocab.usingCapcode, vocab.normalizer)
+	if err != nil {
+		return nil, 0, err
+	}
+	if rng == nil {
+		rng = rand.New(rand.NewSource(rand.Int63()))
+	}
+	tokens, missing := vocab.tokenizeSampled(normalized, temperature, rng)
+	return tokens, missing, nil
+}
+
+// Tokenizes text from bytes slice to the `n` best distinct tokenizations, best first, each with the sum of the scores of the branches chosen to produce it.
+// It's a beam search of width `n` over the same branches that Tokenize chooses between: the longest match, its 2 alternatives, and the variants of each using the delete token.
+// The first tokenization is usually, but not always, the same as from Tokenize. Fewer than `n` are returned if there are not `n` different tokenizations.
+func (vocab *Vocab) TokenizeNBest(data []byte, n int) ([]Segmentation, error) {
+	if n < 1 {
+		return nil, errors.New(`TokenizeNBest requires n to be at least 1`)
+	}
+	if vocab.maxTokenLength == 0 {
+		return []Segmentation{{Tokens:[]uint32{}}}, nil
+	}
+	normalized, err := normalize(data, vocab.usingCapcode, vocab.normalizer)
+	if err != nil {
+		return nil, err
+	}
+	return vocab.tokenizeNBest(normalized, n), nil
+}
+
+
+// Tokenizes text from bytes slice to the same tokens as Tokenize, recording at every step the branches that were considered, the parts of each one's score, and which was chosen.
+// The text is normalized first, so Position in each step is a byte offset in the normalized text, which is also returned.
+// This is for understanding why a text was tokenized the way it was, and is much slower than Tokenize.
+func (vocab *Vocab) TokenizeTrace(data []byte) ([]TraceStep, []byte, error) {
+	if vocab.maxTokenLength == 0 {
+		return []TraceStep{}, []byte{}, nil
+	}
+	normalized, err := normalize(unleak(data), vocab.usingCapcode, vocab.normalizer)
+	if err != nil {
+		return nil, nil, err
+	}
+	return vocab.tokenizeTrace(normalized), normalized, nil
+}
+
+// Tokenizes a string to token IDs.
+// For UTF-16 vocabularies the string is normalized and then converted to UTF-16 little-endian, so it's given in UTF-8 as usual for Go.
+// The 2nd returned value (int) is the number of characters for which there were no tokens and were replaced with Unk token.
+func (vocab *Vocab) TokenizeString(s string) ([]uint32, int, error) {
+	if vocab.charset != 2 {
+		return vocab.Tokenize([]byte(s))
+	}
+	if vocab.maxTokenLength == 0 {
+		return []uint32{}, 0, nil
+	}
+	normalized, err := normalize([]byte(s), vocab.usingCapcode, vocab.normalizer)
+	if err != nil {
+		return nil, 0, err
+	}
+	return vocab.tokenize(encodeUTF16(string(normalized)), nil, nil)
+}
+
+// Tokenizes UTF-16 code units to token IDs, for any charset.
+// A byte order mark at the beginning is removed, and if it's swapped then the code units are swapped, so big-endian text can be given as read.
+// Unpaired surrogates become U+FFFD.
+// The 2nd returned value (int) is the number of characters for which there were no tokens and were replaced with Unk token.
+func (vocab *Vocab) TokenizeUTF16(data []uint16) ([]uint32, int, error) {
+	return vocab.TokenizeString(convertUint16sToString(data))
+}
+
+// Tokenizes text from bytes slice to token IDs, and also returns the range of bytes in the original text that each token was produced from.
+// The offsets are [Start, End) into `data` before normalization and capcode. Unlike Tokenize, `data` is not modified.
+// Tokens that don't represent any of the text, such as the delete token, have Start equal to End.
+// If a character was split into more than one token by normalization (e.g. NFD) then those tokens each cover the whole character.
+// The 3rd returned value (int) is the number of characters for which there were no tokens and were replaced with Unk token.
+func (vocab *Vocab) TokenizeWithOffsets(data []byte) ([]uint32, []Offset, int, error) {
+	if vocab.maxTokenLength == 0 {
+		return []uint32{}, []Offset{}, 0, nil
+	}
+	normalized, normalizedOffsets, err := normalizeWithOffsets(data, vocab.usingCapcode, vocab.charset, vocab.normalizer)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	tokens, offsets, missing := vocab.tokenizeOffsets(normalized)
+	return tokens, composeOffsets(normalizedOffsets, offsets, len(data)), missing, nil
+}
+
+// Tokenizes text from bytes slice to token IDs, first splitting the text on the special tokens in `opts`.
+// Special tokens in AllowSpecial become exactly that special token, and special tokens in DisallowSpecial return an error (AllowSpecial takes precedence).
+// All other text is tokenized normally except that it never produces a special token, so special tokens not in either list are tokenized as ordinary text.
+// The 2nd returned value (int) is the number of characters for which there were no tokens and were replaced with Unk token.
+func (vocab *Vocab) TokenizeWithOptions(data []byte, opts TokenizeOptions) ([]uint32, int, error) {
+	if vocab.maxTokenLength == 0 {
+		return []uint32{}, 0, nil
+	}
+	specials, isSpecial, err := vocab.specialMatches(opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	return vocab.tokenizeSpecial(data, specials, isSpecial)
+}
+
+// Tokenizes, splitting the text on the special tokens to look for, and never producing a special token from the text in between.
+func (vocab *Vocab) tokenizeSpecial(data []byte, specials []specialMatch, isSpecial map[uint32]bool) ([]uint32, int, error) {
+	// Positions of the next occurrence of each special token, -1 if there are no more
+	next := make([]int, len(specials))
+	for i := range next {
+		next[i] = -2
+	}
+	tokens := make([]uint32, 0, (len(data) / 4) + 4)
+	var pos, at, best, n, missing int
+	var normalized []byte
+	var err error
+	for pos < len(data) {
+		at, best = len(data), -1
+		for i, special := range specials {
+			if next[i] != -1 && next[i] < pos {
+				if n = bytes.Index(data[pos:], special.text); n >= 0 {
+					next[i] = pos + n
+				} else {
+					next[i] = -1
+				}
+			}
+			if next[i] >= 0 && (next[i] < at || (next[i] == at && best >= 0 && len(special.text) > len(specials[best].text))) {
+				at, best = next[i], i
+			}
+		}
+		if best >= 0 && !specials[best].allow {
+			return nil, 0, errors.New(`Disallowed special token found in text: ` + string(specials[best].text))
+		}
+		if at > pos {
+			if normalized, err = vocab.normalizeSegment(data[pos:at], pos == 0, at == len(data)); err != nil {
+				return nil, 0, err
+			}
+			tokens, n = vocab.tokenizeWithoutSpecial(normalized, isSpecial, tokens)
+			missing += n
+		}
+		if best >= 0 {
+			tokens = append(tokens, specials[best].id)
+			at += len(specials[best].text)
+		}
+		pos = at
+	}
+	return tokens, missing, nil
+}
+
+// Returns the special tokens to look for in the text and whether each is allowed, and the IDs of all special tokens.
+func (vocab *Vocab) specialMatches(opts TokenizeOptions) ([]specialMatch, map[uint32]bool, error) {
+	space := []byte{' '}
+	if vocab.charset == 2 {
+		space = []byte{' ', 0}
+	}
+	decoded := make(map[string]uint32)
+	isSpecial := make(map[uint32]bool)
+	for _, v := range vocab.SpecialTokens() {
+		isSpecial[v.Id] = true
+		if vocab.normalizer.Flag & normLeadingSpace != 0 && len(v.TokenDecoded) > len(space) { // remove the space added by normalization
+			v.TokenDecoded = bytes.TrimPrefix(v.TokenDecoded, space)
+		}
+		decoded[string(v.TokenDecoded)] = v.Id
+	}
+	var list []specialMatch
+	included := make(map[string]bool)
+	for i, names := range [][]string{opts.AllowSpecial, opts.DisallowSpecial} {
+		if len(names) == 1 && names[0] == `all` {
+			names = nil
+			for s, _ := range decoded {
+				names = append(names, s)
+			}
+		}
+		for _, s := range names {
+			id, found := decoded[s]
+			if !found { // try it normalized, as it would have been when the special token was added
+				if normalized, err := normalize([]byte(s), vocab.usingCapcode, vocab.normalizer); err == nil {
+					if index, exists := vocab.dictionary.Find(normalized); exists && vocab.info[index].alt.data.flag & 64 != 0 {
+						id, found = vocab.info[index].alt.id, true
+					}
+				}
+				if !found {
+					return nil, nil, errors.New(`Not a special token: ` + s)
+				}
+			}
+			if len(s) == 0 || included[s] {
+				continue
+			}
+			included[s] = true
+			list = append(list, specialMatch{text:[]byte(s), id:id, allow:i == 0})
+		}
+	}
+	return list, isSpecial, nil
 }
 
 // Tokenizes but returns the number of tokens instead of the tokens.
@@ -976,7 +1682,7 @@ func (vocab *Vocab) Count(data []byte) (int, int, error) {
 	if err != nil {
 		return 0, 0, err
 	}
-	return vocab.tokenizeCount(normalized)
+	return vocab.tokenizeCount(normalized, len(normalized) * 2)
 }
 
 // Tokenizes directly into serialized bytes with either 16-bit, 24-bit or 32-bit encoded unsigned integers depending on the vocabulary size.
@@ -994,27 +1700,382 @@ func (vocab *Vocab) TokenizeToSerialized(data []byte, encodingLength uint8, buff
 			encodingLength = 3
 		}
 	}
-	normalized, err := normalize(data, vocab.usingCapcode, vocab.normalizer)
-	if err != nil {
-		return nil, 0, 0, err
+	normalized, err := normalize(data, vocab.usingCapcode, vocab.normalizer)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	switch encodingLength {
+		case 2:
+			b, missing := vocab.tokenizeToSerialized16(normalized, buffer, nil)
+			return b, 2, missing, nil
+		case 3:
+			b, missing := vocab.tokenizeToSerialized24(normalized, buffer, nil)
+			return b, 3, missing, nil
+		case 4:
+			b, missing := vocab.tokenizeToSerialized32(normalized, buffer, nil)
+			return b, 4, missing, nil
+		default:
+			return nil, 0, 0, errors.New(`Invalid encoding length`)
+	}
+}
+
+
+// Tokenizes a batch of texts in parallel, returning the tokens for each text in the same order as `texts`.
+// As with Tokenize, the normalizations may be applied to the underlying data of the texts.
+// The 2nd returned value (int) is the total number of characters for which there were no tokens and were replaced with Unk token.
+// If any text can't be tokenized, its tokens are nil and the error returned is that of the first such text.
+func (vocab *Vocab) TokenizeBatch(texts [][]byte, opts BatchOptions) ([][]uint32, int, error) {
+	results := make([][]uint32, len(texts))
+	if vocab.maxTokenLength == 0 {
+		for i := range results {
+			results[i] = []uint32{}
+		}
+		return results, 0, nil
+	}
+	var specials []specialMatch
+	var isSpecial map[uint32]bool
+	var err error
+	if opts.Special != nil {
+		if specials, isSpecial, err = vocab.specialMatches(*opts.Special); err != nil {
+			return nil, 0, err
+		}
+	}
+	missing := make([]int, len(texts))
+	errs := make([]error, len(texts))
+	jobs := make(chan int, len(texts))
+	for i := range texts {
+		jobs <- i
+	}
+	close(jobs)
+	var wg sync.WaitGroup
+	for w := batchWorkers(opts.Workers, len(texts)); w > 0; w-- {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var tokens []uint32
+			var normalized []byte
+			lilbuf := make([]byte, vocab.maxTokenLength)
+			for i := range jobs {
+				if opts.Special != nil {
+					results[i], missing[i], errs[i] = vocab.tokenizeSpecial(texts[i], specials, isSpecial)
+					continue
+				}
+				if normalized, errs[i] = normalize(texts[i], vocab.usingCapcode, vocab.normalizer); errs[i] != nil {
+					continue
+				}
+				tokens, missing[i], _ = vocab.tokenize(normalized, tokens[:0], lilbuf)
+				results[i] = append(make([]uint32, 0, len(tokens)), tokens...)
+			}
+		}()
+	}
+	wg.Wait()
+	return results, sumBatch(missing), firstError(errs)
+}
+
+// Tokenizes a batch of texts in parallel into one contiguous slice of bytes with either 16-bit, 24-bit or 32-bit encoded unsigned integers.
+// Set encodingLength to 0 for it to be chosen automatically, or set `encodingLength` to 2, 3 or 4.
+// The serialized tokens for text `i` are `serialized[offsets[i]:offsets[i+1]]`, so there is 1 more offset than there are texts.
+// The 3rd return value is the encodingLength that was used, and the 4th is the total number of characters for which there were no tokens.
+// If any text can't be tokenized, it has no tokens and the error returned is that of the first such text.
+func (vocab *Vocab) TokenizeBatchToSerialized(texts [][]byte, encodingLength uint8, opts BatchOptions) ([]byte, []int, uint8, int, error) {
+	if encodingLength <= 1 {
+		if len(vocab.reverse) <= 65536 {
+			encodingLength = 2
+		} else {
+			encodingLength = 3
+		}
+	} else if encodingLength > 4 {
+		return nil, nil, 0, 0, errors.New(`Invalid encoding length`)
+	}
+	offsets := make([]int, len(texts) + 1)
+	if vocab.maxTokenLength == 0 {
+		return []byte{}, offsets, encodingLength, 0, nil
+	}
+	var specials []specialMatch
+	var isSpecial map[uint32]bool
+	var err error
+	if opts.Special != nil {
+		if specials, isSpecial, err = vocab.specialMatches(*opts.Special); err != nil {
+			return nil, nil, 0, 0, err
+		}
+	}
+	// Each worker writes into its own arena, which are then joined in order
+	parts := make([]batchPart, len(texts))
+	missing := make([]int, len(texts))
+	errs := make([]error, len(texts))
+	jobs := make(chan int, len(texts))
+	for i := range texts {
+		jobs <- i
+	}
+	close(jobs)
+	workers := batchWorkers(opts.Workers, len(texts))
+	arenas := make([][]byte, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			var tokens []uint32
+			var normalized, buffer []byte
+			lilbuf := make([]byte, vocab.maxTokenLength)
+			for i := range jobs {
+				if opts.Special != nil {
+					if tokens, missing[i], errs[i] = vocab.tokenizeSpecial(texts[i], specials, isSpecial); errs[i] != nil {
+						continue
+					}
+					buffer = appendSerialized(buffer[:0], tokens, encodingLength)
+				} else {
+					if normalized, errs[i] = normalize(texts[i], vocab.usingCapcode, vocab.normalizer); errs[i] != nil {
+						continue
+					}
+					switch encodingLength {
+						case 2:
+							buffer, missing[i] = vocab.tokenizeToSerialized16(normalized, buffer, lilbuf)
+						case 3:
+							buffer, missing[i] = vocab.tokenizeToSerialized24(normalized, buffer, lilbuf)
+						case 4:
+							buffer, missing[i] = vocab.tokenizeToSerialized32(normalized, buffer, lilbuf)
+					}
+				}
+				parts[i] = batchPart{w, len(arenas[w]), len(arenas[w]) + len(buffer)}
+				arenas[w] = append(arenas[w], buffer...)
+			}
+		}(w)
+	}
+	wg.Wait()
+	for i, p := range parts {
+		offsets[i + 1] = offsets[i] + p.end - p.start
+	}
+	serialized := make([]byte, offsets[len(texts)])
+	for i, p := range parts {
+		copy(serialized[offsets[i]:], arenas[p.worker][p.start:p.end])
+	}
+	return serialized, offsets, encodingLength, sumBatch(missing), firstError(errs)
+}
+
+// Splits text into chunks of at most `maxTokens` tokens, with each chunk beginning `overlap` tokens (or slightly more) before the end of the previous chunk.
+// `boundaryPolicy` is BoundaryToken, BoundarySentence or BoundaryParagraph. With BoundarySentence or BoundaryParagraph each chunk ends on the last
+// sentence or paragraph boundary within it, if there is one within the 2nd half of the chunk, otherwise it falls back to the next best boundary.
+// A chunk never ends in the middle of a word, character or capcode marker (unless that is impossible within `maxTokens`), so each chunk decodes by itself to its range of the original text.
+func (vocab *Vocab) Chunk(data []byte, maxTokens int, overlap int, boundaryPolicy uint8) ([]Chunk, error) {
+	if maxTokens < 1 || overlap < 0 || overlap >= maxTokens {
+		return nil, errors.New(`Chunk requires maxTokens > overlap >= 0`)
+	}
+	tokens, offsets, _, err := vocab.TokenizeWithOffsets(data)
+	if err != nil {
+		return nil, err
+	}
+	var chunks []Chunk
+	var start, end, k, level, bestLevel int
+	for start < len(tokens) {
+		end = branchless.Min(start + maxTokens, len(tokens))
+		if end < len(tokens) {
+			// Find the best boundary, preferring the policy and then the latest
+			k, bestLevel = end, -1
+			for i := end; i > start; i-- {
+				if level = vocab.chunkBoundary(data, tokens, offsets, i); level < 0 {
+					continue
+				}
+				level = branchless.Min(level, int(boundaryPolicy))
+				if i <= start + ((end - start) / 2) && level > 0 { // only use a sentence or paragraph boundary if it's in the 2nd half
+					level = 0
+				}
+				if level > bestLevel {
+					k, bestLevel = i, level
+				}
+			}
+			end = k
+		}
+		chunks = append(chunks, Chunk{Tokens:tokens[start:end], Start:offsets[start].Start, End:offsets[end - 1].End})
+		if end == len(tokens) {
+			break
+		}
+		// Begin the next chunk on the latest safe boundary that gives the overlap
+		k = end
+		for i := end - overlap; i > start && overlap > 0; i-- {
+			if vocab.chunkBoundary(data, tokens, offsets, i) >= 0 {
+				k = i
+				break
+			}
+		}
+		start = k
+	}
+	return chunks, nil
+}
+
+// Returns whether `pos` is not in the middle of a UTF-8 or UTF-16 character.
+func (vocab *Vocab) isCharacterBoundary(data []byte, pos int) bool {
+	if pos <= 0 || pos >= len(data) {
+		return true
+	}
+	switch vocab.charset {
+		case 1:
+			return utf8.RuneStart(data[pos])
+		case 2:
+			return pos % 2 == 0 && (pos + 1 >= len(data) || data[pos + 1] < 0xDC || data[pos + 1] > 0xDF) // not a low surrogate
+	}
+	return true
+}
+
+// Returns whether the text can be split before token `k`: -1 if not, otherwise 2 for a paragraph boundary, 1 for a sentence boundary, or 0.
+func (vocab *Vocab) chunkBoundary(data []byte, tokens []uint32, offsets []Offset, k int) int {
+	prev, next := vocab.IdToToken(tokens[k - 1]), vocab.IdToToken(tokens[k])
+	pos := offsets[k].Start
+	// Don't split characters or capcode markers
+	if offsets[k - 1].End > pos || tokens[k - 1] == vocab.deleteToken || !vocab.isCharacterBoundary(data, pos) {
+		return -1
+	}
+	if len(prev) > 0 && len(next) > 0 {
+		last := decodeLastRune(prev, vocab.charset)
+		first, _ := decodeRune(next, vocab.charset)
+		if isCapcode(last, vocab.usingCapcode) || (isLetter(last, vocab.usingCapcode) && isLetter(first, vocab.usingCapcode)) {
+			return -1
+		}
+	}
+	// Look at the whitespace around the boundary
+	unit := 1
+	if vocab.charset == 2 {
+		unit = 2
+	}
+	var newlines int
+	var r rune
+	i, j := pos, pos
+	for ; i >= unit; i -= unit {
+		if r = decodeLastRune(data[:i], vocab.charset); r != ' ' && r != '\t' && r != '\r' && r != '\n' {
+			break
+		}
+		if r == '\n' {
+			newlines++
+		}
+	}
+	for ; j + unit <= len(data); j += unit {
+		if r, _ = decodeRune(data[j:], vocab.charset); r != ' ' && r != '\t' && r != '\r' && r != '\n' {
+			break
+		}
+		if r == '\n' {
+			newlines++
+		}
+	}
+	if newlines >= 2 {
+		return 2
+	}
+	if newlines == 1 {
+		return 1
+	}
+	if (i < pos || j > pos) && i >= unit {
+		switch decodeLastRune(data[:i], vocab.charset) {
+			case '.', '!', '?', '。', '！', '？':
+				return 1
+		}
+	}
+	return 0
+}
+
+// Returns the longest beginning of the text (or end, if `fromEnd` is true) that tokenizes to no more than `maxTokens` tokens.
+// The text returned is a slice of `data`, which is not modified, and is never cut in the middle of a character.
+// Only the part of the text near the cut is tokenized. The cut is checked by counting the tokens of the text that would be returned,
+// because tokenizing the text by itself can give different tokens either side of the cut, so the nearby cuts are checked too.
+func (vocab *Vocab) TruncateText(data []byte, maxTokens int, fromEnd bool) ([]byte, error) {
+	if maxTokens <= 0 || vocab.maxTokenLength == 0 {
+		if fromEnd {
+			return data[len(data):], nil
+		}
+		return data[:0], nil
+	}
+	const drift = 3 // how many tokens over the limit a cut can be before giving up on longer texts
+	const margin = 16 // how many more tokens than the limit to tokenize
+	var tokens []uint32
+	var offsets []Offset
+	var window, offset, k, n, best, pos int
+	var text []byte
+	var err error
+	// Tokenize a window at the beginning or end, enlarging it until it has enough tokens
+	for window = (maxTokens + margin) * vocab.maxTokenLength; ; window *= 2 {
+		window = branchless.Min(window, len(data))
+		text = data[:window]
+		if fromEnd { // the window starts at the next character boundary, so it can be shorter than `window`
+			for offset = len(data) - window; !vocab.isCharacterBoundary(data, offset); offset++ {}
+			text = data[offset:]
+		}
+		if tokens, offsets, _, err = vocab.TokenizeWithOffsets(text); err != nil {
+			return nil, err
+		}
+		if window == len(data) {
+			if len(tokens) <= maxTokens {
+				return data, nil
+			}
+			break
+		}
+		if len(tokens) > maxTokens + margin {
+			break
+		}
+	}
+	// The cut that keeps `k` tokens of the window, or -1 if it would split a character
+	cut := func(k int) int {
+		j := k
+		if fromEnd {
+			j = len(tokens) - k
+		}
+		if offsets[j - 1].End > offsets[j].Start || !vocab.isCharacterBoundary(data, offset + offsets[j].Start) {
+			return -1
+		}
+		return offset + offsets[j].Start
+	}
+	count := func(pos int) (int, error) {
+		if fromEnd {
+			return vocab.countUpTo(data[pos:], maxTokens + drift)
+		}
+		return vocab.countUpTo(data[:pos], maxTokens + drift)
+	}
+	// Go back until it fits, then forward in case a longer text also fits
+	best = -1
+	for k = branchless.Min(maxTokens, len(tokens) - 1); k > 0 && best < 0; k-- {
+		if pos = cut(k); pos >= 0 {
+			if n, err = count(pos); err != nil {
+				return nil, err
+			}
+			if n <= maxTokens {
+				best = pos
+			}
+		}
+	}
+	if best < 0 {
+		if fromEnd {
+			return data[len(data):], nil
+		}
+		return data[:0], nil
 	}
-	switch encodingLength {
-		case 2:
-			b, missing := vocab.tokenizeToSerialized16(normalized, buffer)
-			return b, 2, missing, nil
-		case 3:
-			b, missing := vocab.tokenizeToSerialized24(normalized, buffer)
-			return b, 3, missing, nil
-		case 4:
-			b, missing := vocab.tokenizeToSerialized32(normalized, buffer)
-			return b, 4, missing, nil
-		default:
-			return nil, 0, 0, errors.New(`Invalid encoding length`)
+	for k += 2; k < len(tokens); k++ {
+		if pos = cut(k); pos >= 0 {
+			if n, err = count(pos); err != nil {
+				return nil, err
+			}
+			if n > maxTokens + drift {
+				break
+			}
+			if n <= maxTokens {
+				best = pos
+			}
+		}
+	}
+	if fromEnd {
+		return data[best:], nil
 	}
+	return data[:best], nil
 }
 
+// Counts the tokens in a copy of the text, stopping if there are more than `limit`.
+func (vocab *Vocab) countUpTo(data []byte, limit int) (int, error) {
+	normalized, err := normalize(unleak(data), vocab.usingCapcode, vocab.normalizer)
+	if err != nil {
+		return 0, err
+	}
+	n, _, err := vocab.tokenizeCount(normalized, limit)
+	return n, err
+}
 
-func (vocab Vocab) tokenize(data []byte) ([]uint32, int, error) {
+// `tokens` and `lilbuf` are optional reusable buffers, you can send nil.
+func (vocab Vocab) tokenize(data []byte, tokens []uint32, lilbuf []byte) ([]uint32, int, error) {
 	var i, i1, i2, i3, length, length1, length2, length3, length1b, length2b, length3b int
 	var index, index1, index2, index3, index1b, index2b, index3b uint32
 	var branchLength, missing, nWords int
@@ -1024,9 +2085,13 @@ func (vocab Vocab) tokenize(data []byte) ([]uint32, int, error) {
 	var nextByte uint8
 	var original tokenOuter
 	var first, second tokenInner
-	tokens := make([]uint32, 0, (len(data) / 4) + 4)
+	if tokens == nil {
+		tokens = make([]uint32, 0, (len(data) / 4) + 4)
+	}
 
-	lilbuf := make([]byte, vocab.maxTokenLength)
+	if len(lilbuf) < vocab.maxTokenLength {
+		lilbuf = make([]byte, vocab.maxTokenLength)
+	}
 	lilbuf[0] = 32
 	lilbufOffset := 1
 	if vocab.charset == 2 {
@@ -1278,7 +2343,85 @@ func (vocab Vocab) tokenize(data []byte) ([]uint32, int, error) {
 	return tokens, missing, nil
 }
 
-func (vocab Vocab) tokenizeCount(data []byte) (int, int, error) {
+// Tokenizes the same as tokenize except that the branch is chosen at random, weighted by its score, instead of always choosing the highest scoring branch.
+func (vocab Vocab) tokenizeSampled(data []byte, temperature float64, rng *rand.Rand) ([]uint32, int) {
+	var i, length, forwardDelete, missing, k int
+	var index uint32
+	var found, matched bool
+	var list []branch
+	tokens := make([]uint32, 0, (len(data) / 4) + 4)
+
+	lilbuf := make([]byte, vocab.maxTokenLength)
+	lilbuf[0] = 32
+
+	// Add 1 extra byte to the end because we look ahead 1 byte
+	lenData := len(data)
+	if cap(data) > len(data) {
+		data = data[0 : len(data) + 1]
+	} else {
+		data2 := make([]byte, len(data) + 1)
+		copy(data2, data)
+		data = data2
+	}
+
+	for i < lenData {
+		if !matched {
+			if index, length, found = vocab.dictionary.LongestSubstring(data[ i : i + branchless.Min(lenData - i, vocab.maxTokenLength) ]); !found {
+				if vocab.unkToken != DOES_NOT_EXIST {
+					tokens = append(tokens, vocab.unkToken)
+				}
+				i++
+				missing++
+				forwardDelete = 0
+				continue
+			}
+		}
+		list = vocab.branches(data, lenData, lilbuf, i, length, index, forwardDelete, list[:0])
+		if len(list) == 0 {
+			tokens = append(tokens, vocab.info[index].alt.id)
+			i += length // forwardDelete is already applied to length
+			forwardDelete = 0
+			matched = false
+			continue
+		}
+		k = sampleBranch(list, temperature, rng)
+		tokens = append(tokens, list[k].tokens[:list[k].nTokens]...)
+		i += list[k].advance
+		length = list[k].length
+		index = list[k].index
+		forwardDelete = list[k].forwardDelete
+		matched = true
+	}
+	return tokens, missing
+}
+
+// Chooses one of the branches with probability proportional to exp((score - bestScore) / temperature), `list` must not be empty.
+func sampleBranch(list []branch, temperature float64, rng *rand.Rand) int {
+	var weights [6]float64 // there are at most 6 branches
+	var total float64
+	best := 0
+	for k := range list {
+		if list[k].score > list[best].score {
+			best = k
+		}
+	}
+	for k := range list {
+		weights[k] = math.Exp(float64(list[k].score - list[best].score) / temperature)
+		total += weights[k]
+	}
+	r := rng.Float64() * total
+	for k := range list {
+		if r < weights[k] {
+			return k
+		}
+		r -= weights[k]
+	}
+	// Rounding error, choose the best branch
+	return best
+}
+
+// Stops counting as soon as the number of tokens is more than `limit`.
+func (vocab Vocab) tokenizeCount(data []byte, limit int) (int, int, error) {
 	var i, i1, i2, i3, length, length1, length2, length3, length1b, length2b, length3b int
 	var index, index1, index2, index3, index1b, index2b, index3b uint32
 	var branchLength, missing, nWords int
@@ -1309,11 +2452,14 @@ func (vocab Vocab) tokenizeCount(data []byte) (int, int, error) {
 		data = data2
 	}
 
-	for i < lenData {
+	for i < lenData && tokens <= limit {
 		if index, length, found = vocab.dictionary.LongestSubstring(data[ i : i + branchless.Min(lenData - i, vocab.maxTokenLength) ]); found {
 			
 			checkpoint:
 
+				if tokens > limit {
+					break
+				}
 				original = vocab.info[index].alt
 				i1 = i + length
 
@@ -1503,21 +2649,21 @@ func (vocab Vocab) tokenizeCount(data []byte) (int, int, error) {
 							forwardDelete = 0
 							goto checkpoint
 						case score1b:
-							tokens++
+							tokens += 2
 							i += length
 							length = length1b
 							index = index1b
 							forwardDelete = 1
 							goto checkpoint
 						case score2b:
-							tokens++
+							tokens += 2
 							i += original.length - forwardDelete
 							length = length2b
 							index = index2b
 							forwardDelete = 1
 							goto checkpoint
 						case score3b:
-							tokens++
+							tokens += 2
 							i += original.length2 - forwardDelete
 							length = length3b
 							index = index3b
@@ -1542,7 +2688,7 @@ func (vocab Vocab) tokenizeCount(data []byte) (int, int, error) {
 	return tokens, missing, nil
 }
 
-func (vocab Vocab) tokenizeToSerialized16(data []byte, buffer []byte) ([]byte, int) {
+func (vocab Vocab) tokenizeToSerialized16(data []byte, buffer []byte, lilbuf []byte) ([]byte, int) {
 	var i, i1, i2, i3, length, length1, length2, length3, length1b, length2b, length3b int
 	var index, index1, index2, index3, index1b, index2b, index3b uint32
 	var branchLength, missing, nWords int
@@ -1560,7 +2706,9 @@ func (vocab Vocab) tokenizeToSerialized16(data []byte, buffer []byte) ([]byte, i
 		buffer = make([]byte, 0, length)
 	}
 
-	lilbuf := make([]byte, vocab.maxTokenLength)
+	if len(lilbuf) < vocab.maxTokenLength {
+		lilbuf = make([]byte, vocab.maxTokenLength)
+	}
 	lilbuf[0] = 32
 	lilbufOffset := 1
 	if vocab.charset == 2 {
@@ -1814,7 +2962,7 @@ func (vocab Vocab) tokenizeToSerialized16(data []byte, buffer []byte) ([]byte, i
 	return buffer, missing
 }
 
-func (vocab Vocab) tokenizeToSerialized24(data []byte, buffer []byte) ([]byte, int) {
+func (vocab Vocab) tokenizeToSerialized24(data []byte, buffer []byte, lilbuf []byte) ([]byte, int) {
 	var i, i1, i2, i3, length, length1, length2, length3, length1b, length2b, length3b int
 	var index, index1, index2, index3, index1b, index2b, index3b uint32
 	var branchLength, missing, nWords int
@@ -1832,7 +2980,9 @@ func (vocab Vocab) tokenizeToSerialized24(data []byte, buffer []byte) ([]byte, i
 		buffer = make([]byte, 0, length)
 	}
 
-	lilbuf := make([]byte, vocab.maxTokenLength)
+	if len(lilbuf) < vocab.maxTokenLength {
+		lilbuf = make([]byte, vocab.maxTokenLength)
+	}
 	lilbuf[0] = 32
 	lilbufOffset := 1
 	if vocab.charset == 2 {
@@ -2086,7 +3236,7 @@ func (vocab Vocab) tokenizeToSerialized24(data []byte, buffer []byte) ([]byte, i
 	return buffer, missing
 }
 
-func (vocab Vocab) tokenizeToSerialized32(data []byte, buffer []byte) ([]byte, int) {
+func (vocab Vocab) tokenizeToSerialized32(data []byte, buffer []byte, lilbuf []byte) ([]byte, int) {
 	var i, i1, i2, i3, length, length1, length2, length3, length1b, length2b, length3b int
 	var index, index1, index2, index3, index1b, index2b, index3b uint32
 	var branchLength, missing, nWords int
@@ -2104,7 +3254,9 @@ func (vocab Vocab) tokenizeToSerialized32(data []byte, buffer []byte) ([]byte, i
 		buffer = make([]byte, 0, length)
 	}
 
-	lilbuf := make([]byte, vocab.maxTokenLength)
+	if len(lilbuf) < vocab.maxTokenLength {
+		lilbuf = make([]byte, vocab.maxTokenLength)
+	}
 	lilbuf[0] = 32
 	lilbufOffset := 1
 	if vocab.charset == 2 {
@@ -2339,23 +3491,660 @@ func (vocab Vocab) tokenizeToSerialized32(data []byte, buffer []byte) ([]byte, i
 							goto checkpoint
 					}
 				}
-				// Skipped this branch (or case -1000000 from scores)
-				buffer = append(buffer, uint8(original.id), uint8(original.id >> 8), uint8(original.id >> 16), 0)
-				i += length // forwardDelete is already applied to length
-				forwardDelete = 0
+				// Skipped this branch (or case -1000000 from scores)
+				buffer = append(buffer, uint8(original.id), uint8(original.id >> 8), uint8(original.id >> 16), 0)
+				i += length // forwardDelete is already applied to length
+				forwardDelete = 0
+
+		} else { // !found
+			if vocab.unkToken != DOES_NOT_EXIST {
+				index = vocab.unkToken
+				buffer = append(buffer, uint8(index), uint8(index >> 8), uint8(index >> 16), 0)
+			}
+			i++
+			missing++
+			forwardDelete = 0
+		}
+	}
+	
+	return buffer, missing
+}
+
+// Tokenizes the same as tokenize, and also returns the range of bytes in data that each token covers.
+func (vocab Vocab) tokenizeOffsets(data []byte) ([]uint32, []Offset, int) {
+	var i, length, forwardDelete, missing, best, k int
+	var index uint32
+	var found, matched bool
+	var list []branch
+	tokens := make([]uint32, 0, (len(data) / 4) + 4)
+	offsets := make([]Offset, 0, (len(data) / 4) + 4)
+
+	lilbuf := make([]byte, vocab.maxTokenLength)
+	lilbuf[0] = 32
+
+	// Add 1 extra byte to the end because we look ahead 1 byte
+	lenData := len(data)
+	if cap(data) > len(data) {
+		data = data[0 : len(data) + 1]
+	} else {
+		data2 := make([]byte, len(data) + 1)
+		copy(data2, data)
+		data = data2
+	}
+
+	for i < lenData {
+		if !matched {
+			if index, length, found = vocab.dictionary.LongestSubstring(data[ i : i + branchless.Min(lenData - i, vocab.maxTokenLength) ]); !found {
+				if vocab.unkToken != DOES_NOT_EXIST {
+					tokens = append(tokens, vocab.unkToken)
+					offsets = append(offsets, Offset{i, i + 1})
+				}
+				i++
+				missing++
+				forwardDelete = 0
+				continue
+			}
+		}
+		list = vocab.branches(data, lenData, lilbuf, i, length, index, forwardDelete, list[:0])
+		if len(list) == 0 {
+			tokens = append(tokens, vocab.info[index].alt.id)
+			offsets = append(offsets, Offset{i, i + length})
+			i += length // forwardDelete is already applied to length
+			forwardDelete = 0
+			matched = false
+			continue
+		}
+		// The first of the highest scoring branches is chosen, as in tokenize
+		best = 0
+		for k = range list {
+			if list[k].score > list[best].score {
+				best = k
+			}
+		}
+		tokens = append(tokens, list[best].tokens[:list[best].nTokens]...)
+		offsets = append(offsets, Offset{i, i + list[best].advance})
+		if list[best].nTokens == 2 { // the delete token doesn't cover any of the text
+			offsets = append(offsets, Offset{i + list[best].advance, i + list[best].advance})
+		}
+		i += list[best].advance
+		length = list[best].length
+		index = list[best].index
+		forwardDelete = list[best].forwardDelete
+		matched = true
+	}
+	return tokens, offsets, missing
+}
+
+// Tokenizes normalized text without producing any special tokens, by splitting the text after the first character of any special token that was found.
+// Tokens are appended to `tokens`, and the 2nd returned value is the number of characters for which there were no tokens.
+func (vocab Vocab) tokenizeWithoutSpecial(data []byte, isSpecial map[uint32]bool, tokens []uint32) ([]uint32, int) {
+	var missing, split, n, k int
+	var toks []uint32
+	var offsets []Offset
+	for len(data) > 0 {
+		toks, offsets, n = vocab.tokenizeOffsets(data)
+		split = 0
+		for k = 0; k < len(toks); k++ {
+			if isSpecial[toks[k]] {
+				_, split = decodeRune(data[offsets[k].Start:], vocab.charset)
+				split = offsets[k].Start + branchless.Max(split, 1)
+				if split < offsets[k].End { // a special token that is a single character can't be avoided
+					break
+				}
+				split = 0
+			}
+		}
+		if split == 0 {
+			return append(tokens, toks...), missing + n
+		}
+		tokens, n = vocab.tokenizeWithoutSpecial(data[:split], isSpecial, tokens)
+		missing += n
+		data = data[split:]
+	}
+	return tokens, missing
+}
+
+// Beam search for TokenizeNBest, `data` must already be normalized.
+func (vocab Vocab) tokenizeNBest(data []byte, n int) []Segmentation {
+	var beam, next, finished []nbestState
+	var list []branch
+	var state nbestState
+	var minPos, k int
+	var found bool
+	var keyBuf []byte
+
+	lilbuf := make([]byte, vocab.maxTokenLength)
+	lilbuf[0] = 32
+
+	// Add 1 extra byte to the end because we look ahead 1 byte
+	lenData := len(data)
+	data2 := make([]byte, lenData + 1)
+	copy(data2, data)
+	data = data2
+
+	beam = append(beam, nbestState{tokens:make([]uint32, 0, (lenData / 4) + 4)})
+	for len(beam) > 0 {
+		// Only the states furthest behind are moved forward, so that the states compared with each other have covered similar amounts of the text
+		minPos = lenData
+		for _, state = range beam {
+			minPos = branchless.Min(minPos, state.i)
+		}
+		next = next[:0]
+		for _, state = range beam {
+			if state.i != minPos {
+				next = append(next, state)
+				continue
+			}
+			if !state.matched {
+				if state.i >= lenData {
+					finished = append(finished, state)
+					continue
+				}
+				if state.index, state.length, found = vocab.dictionary.LongestSubstring(data[ state.i : state.i + branchless.Min(lenData - state.i, vocab.maxTokenLength) ]); found {
+					state.matched = true
+				} else {
+					if vocab.unkToken != DOES_NOT_EXIST {
+						state.tokens = append(state.tokens, vocab.unkToken)
+					}
+					state.i++
+					state.missing++
+					state.forwardDelete = 0
+				}
+				next = append(next, state)
+				continue
+			}
+			list = vocab.branches(data, lenData, lilbuf, state.i, state.length, state.index, state.forwardDelete, list[:0])
+			if len(list) == 0 {
+				state.tokens = append(state.tokens, vocab.info[state.index].alt.id)
+				state.i += state.length // forwardDelete is already applied to length
+				state.forwardDelete = 0
+				state.matched = false
+				next = append(next, state)
+				continue
+			}
+			for k = range list {
+				tokens := make([]uint32, len(state.tokens), len(state.tokens) + list[k].nTokens + (lenData - state.i) / 4)
+				copy(tokens, state.tokens)
+				next = append(next, nbestState{
+					tokens: append(tokens, list[k].tokens[:list[k].nTokens]...),
+					i: state.i + list[k].advance,
+					length: list[k].length,
+					index: list[k].index,
+					forwardDelete: list[k].forwardDelete,
+					score: state.score + list[k].score,
+					missing: state.missing,
+					matched: true,
+				})
+			}
+		}
+		sort.SliceStable(next, func(a, b int) bool { return next[a].score > next[b].score })
+		if len(next) > n {
+			next = next[:n]
+		}
+		beam, next = next, beam
+	}
+
+	sort.SliceStable(finished, func(a, b int) bool { return finished[a].score > finished[b].score })
+	segmentations := make([]Segmentation, 0, n)
+	seen := make(map[string]bool)
+	for _, state = range finished {
+		keyBuf = appendSerialized(keyBuf[:0], state.tokens, 4)
+		key := string(keyBuf)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		segmentations = append(segmentations, Segmentation{Tokens:state.tokens, Score:state.score, Missing:state.missing})
+		if len(segmentations) == n {
+			break
+		}
+	}
+	return segmentations
+}
+
+// Tokenizes the same as tokenize, choosing between the branches from the branches method and recording each step.
+func (vocab Vocab) tokenizeTrace(data []byte) []TraceStep {
+	var i, length, forwardDelete, best, k int
+	var index uint32
+	var found, matched bool
+	var list []branch
+	var original tokenOuter
+	var step TraceStep
+	steps := make([]TraceStep, 0, (len(data) / 4) + 4)
+
+	lilbuf := make([]byte, vocab.maxTokenLength)
+	lilbuf[0] = 32
+
+	// Add 1 extra byte to the end because we look ahead 1 byte
+	lenData := len(data)
+	data2 := make([]byte, lenData + 1)
+	copy(data2, data)
+	data = data2
+
+	for i < lenData {
+		if !matched {
+			if index, length, found = vocab.dictionary.LongestSubstring(data[ i : i + branchless.Min(lenData - i, vocab.maxTokenLength) ]); !found {
+				step = TraceStep{Position:i, Longest:DOES_NOT_EXIST, Chosen:-1, Reason:`no token`, Tokens:[]uint32{}, Missing:true}
+				if vocab.unkToken != DOES_NOT_EXIST {
+					step.Tokens = append(step.Tokens, vocab.unkToken)
+				}
+				steps = append(steps, step)
+				i++
+				forwardDelete = 0
+				continue
+			}
+		}
+		original = vocab.info[index].alt
+		step = TraceStep{Position:i, Longest:original.id, AfterDelete:forwardDelete == 1, Chosen:-1}
+		list = vocab.branches(data, lenData, lilbuf, i, length, index, forwardDelete, list[:0])
+		if len(list) == 0 {
+			switch {
+				case i + length >= lenData:
+					step.Reason = `end of text`
+				case original.data.flag & 32 != 0 && vocab.beginByte[data[i + length]] == 12:
+					step.Reason = `whole word`
+				default:
+					step.Reason = `no branch found`
+			}
+			step.Tokens = []uint32{original.id}
+			steps = append(steps, step)
+			i += length // forwardDelete is already applied to length
+			forwardDelete = 0
+			matched = false
+			continue
+		}
+		// The first of the highest scoring branches is chosen, as in tokenize
+		best = 0
+		step.Candidates = make([]TraceCandidate, len(list))
+		for k = range list {
+			if list[k].score > list[best].score {
+				best = k
+			}
+			step.Candidates[k] = TraceCandidate{Tokens:append([]uint32{}, list[k].tokens[:list[k].nTokens]...), Next:vocab.info[list[k].index].alt.id, Score:list[k].score, Parts:list[k].parts}
+			switch list[k].tokens[0] {
+				case original.id1:
+					step.Candidates[k].Branch = `alternative1`
+				case original.id2:
+					step.Candidates[k].Branch = `alternative2`
+				default:
+					step.Candidates[k].Branch = `longest`
+			}
+			if list[k].nTokens == 2 {
+				step.Candidates[k].Branch += `+delete`
+			}
+		}
+		step.Chosen = best
+		step.Tokens = step.Candidates[best].Tokens
+		steps = append(steps, step)
+		i += list[best].advance
+		length = list[best].length
+		index = list[best].index
+		forwardDelete = list[best].forwardDelete
+		matched = true
+	}
+	return steps
+}
+
+// Appends to `list` the branches that tokenize chooses between at position `i`, where the longest match is `index` of `length` bytes, in the order tokenize prefers them when their scores are equal.
+// They are scored exactly as in tokenize. Nothing is appended if tokenize would take the longest match without checking alternatives. `lilbuf` must be at least maxTokenLength bytes beginning with a space.
+func (vocab Vocab) branches(data []byte, lenData int, lilbuf []byte, i int, length int, index uint32, forwardDelete int, list []branch) []branch {
+	var i1, i2, i3, length1, length2, length3, length1b, length2b, length3b int
+	var index1, index2, index3, index1b, index2b, index3b uint32
+	var nWords int
+	var found1, found2, found3 bool
+	var nextByte uint8
+	var first, second tokenInner
+	var b1b, b2b, b3b branch
+	var has1b, has2b, has3b bool
+
+	lilbufOffset := 1
+	if vocab.charset == 2 {
+		lilbufOffset = 2
+	}
+	lilbufStart := lilbuf[lilbufOffset:]
+	maxTokenLengthWithSpace := vocab.maxTokenLength - lilbufOffset
+
+	original := vocab.info[index].alt
+	i1 = i + length
+
+	// Skip checking alternatives if the longest first match is a single whole word of only letters: begins _A + ends A + next_is_space + 1word
+	if i1 >= lenData || (original.data.flag & 32 != 0 && vocab.beginByte[data[i1]] == 12) {
+		return list
+	}
+
+	// First lookahead to the next token after me
+	index1, length1, found1 = vocab.dictionary.LongestSubstring(data[ i1 : i1 + branchless.Min(lenData - i1, vocab.maxTokenLength) ])
+
+	if found1 {
+		nWords = int(original.data.nWords) - forwardDelete
+		second = vocab.info[index1].alt.data
+		nextByte = vocab.beginByte[data[i1 + length1]]
+		list = append(list, newBranch([2]uint32{original.id}, 1, length, length1, index1, 0,
+			branchScore(original.data, second, nWords, length + length1, length, nextByte, false, false)))
+
+		// Check if we're in the middle of a word
+		if vocab.deleteToken != DOES_NOT_EXIST && second.flag & 2 != 0 && nextByte == 1 && second.nWords == 0 {
+			length1b = branchless.Min(lenData - i1, maxTokenLengthWithSpace)
+			copy(lilbufStart, data[ i1 : i1 + length1b ])
+			index1b, length1b, _ = vocab.dictionary.LongestSubstring(lilbuf[:length1b + lilbufOffset])
+			if length1b > length1 + 1 {
+				length1b -= lilbufOffset
+				second = vocab.info[index1b].alt.data
+				nextByte = vocab.beginByte[data[i1 + length1b]]
+				has1b = true
+				b1b = newBranch([2]uint32{original.id, vocab.deleteToken}, 2, length, length1b, index1b, 1,
+					branchScore(original.data, second, nWords, length + length1b, length, nextByte, true, false))
+			}
+		}
+	}
+
+	if original.index != DOES_NOT_EXIST {
+		i2 = i + original.length - forwardDelete
+		index2, length2, found2 = vocab.dictionary.LongestSubstring(data[ i2 : i2 + branchless.Min(lenData - i2, vocab.maxTokenLength) ])
+
+		if found2 {
+			first = vocab.info[original.index].alt.data
+			nWords = int(first.nWords) - forwardDelete
+			second = vocab.info[index2].alt.data
+			nextByte = vocab.beginByte[data[i2 + length2]]
+			list = append(list, newBranch([2]uint32{original.id1}, 1, original.length - forwardDelete, length2, index2, 0,
+				branchScore(first, second, nWords, original.length + length2 - forwardDelete, length, nextByte, false, true)))
+
+			// Check if we're in the middle of a word
+			if vocab.deleteToken != DOES_NOT_EXIST && second.flag & 2 != 0 && nextByte == 1 && second.nWords == 0 {
+				length2b = branchless.Min(lenData - i2, maxTokenLengthWithSpace)
+				copy(lilbufStart, data[ i2 : i2 + length2b ])
+				index2b, length2b, _ = vocab.dictionary.LongestSubstring(lilbuf[:length2b + lilbufOffset])
+				if length2b > length2 + 1 {
+					length2b -= lilbufOffset
+					second = vocab.info[index2b].alt.data
+					nextByte = vocab.beginByte[data[i2 + length2b]]
+					has2b = true
+					b2b = newBranch([2]uint32{original.id1, vocab.deleteToken}, 2, original.length - forwardDelete, length2b, index2b, 1,
+						branchScore(first, second, nWords, original.length + length2b - forwardDelete, length, nextByte, true, true))
+				}
+			}
+		}
+
+		if original.index2 != DOES_NOT_EXIST {
+			i3 = i + original.length2 - forwardDelete
+			index3, length3, found3 = vocab.dictionary.LongestSubstring(data[ i3 : i3 + branchless.Min(lenData - i3, vocab.maxTokenLength) ])
+
+			if found3 {
+				first = vocab.info[original.index2].alt.data
+				nWords = int(first.nWords) - forwardDelete
+				second = vocab.info[index3].alt.data
+				nextByte = vocab.beginByte[data[i3 + length3]]
+				list = append(list, newBranch([2]uint32{original.id2}, 1, original.length2 - forwardDelete, length3, index3, 0,
+					branchScore(first, second, nWords, original.length2 + length3 - forwardDelete, length, nextByte, false, true)))
+
+				// Check if we're in the middle of a word
+				if vocab.deleteToken != DOES_NOT_EXIST && second.flag & 2 != 0 && nextByte == 1 && second.nWords == 0 {
+					length3b = branchless.Min(lenData - i3, maxTokenLengthWithSpace)
+					copy(lilbufStart, data[ i3 : i3 + length3b ])
+					index3b, length3b, _ = vocab.dictionary.LongestSubstring(lilbuf[:length3b + lilbufOffset])
+					if length3b > length3 + 1 {
+						length3b -= lilbufOffset
+						second = vocab.info[index3b].alt.data
+						nextByte = vocab.beginByte[data[i3 + length3b]]
+						has3b = true
+						b3b = newBranch([2]uint32{original.id2, vocab.deleteToken}, 2, original.length2 - forwardDelete, length3b, index3b, 1,
+							branchScore(first, second, nWords, original.length2 + length3b - forwardDelete, length, nextByte, true, true))
+					}
+				}
+			}
+		}
+	}
+
+	// The delete token variants come after the others, as in the order of the cases in tokenize
+	if has1b {
+		list = append(list, b1b)
+	}
+	if has2b {
+		list = append(list, b2b)
+	}
+	if has3b {
+		list = append(list, b3b)
+	}
+	return list
+}
+
+// The score, which is the sum of the parts.
+func (p ScoreParts) Total() int {
+	return p.Length + p.Types + p.WordBeginnings + p.BeginsSpace + p.SpaceAfter + p.WholeWords + p.SplitWord + p.SplitCapcode + p.EndsInWord + p.ExtraToken + p.Shorter + p.SameLength
+}
+
+func newBranch(tokens [2]uint32, nTokens int, advance int, length int, index uint32, forwardDelete int, parts ScoreParts) branch {
+	return branch{tokens:tokens, nTokens:nTokens, advance:advance, length:length, index:index, forwardDelete:forwardDelete, parts:parts, score:parts.Total()}
+}
+
+// The score of a branch of 2 tokens, `first` and `second`, as calculated in tokenize.
+// `length` is the length of the longest first token, `deleted` is whether the delete token is between them, and `alternative` is whether `first` is one of the alternatives instead of the longest first token.
+func branchScore(first tokenInner, second tokenInner, nWords int, branchLength int, length int, nextByte uint8, deleted bool, alternative bool) ScoreParts {
+	parts := ScoreParts{
+		Length: branchLength,
+		Types: int((first.flag >> 7) + (second.flag >> 7)),
+		WordBeginnings: branchless.MaxZeroAnd(nWords - 1) + branchless.MaxZeroAnd(int(second.nWords) - 1),
+		SpaceAfter: int((nextByte >> 2) & 1),
+		WholeWords: (nWords + int(second.nWords + (nextByte >> 3))) * 100,
+		SplitCapcode: -(int((first.flag >> 3) & 1 & (second.flag >> 4)) * 100),
+		EndsInWord: -(int(second.flag & 1 & nextByte) * 3),
+	}
+	if deleted {
+		parts.SplitWord = -(int(first.flag & 1) * 103)
+		parts.ExtraToken = -1
+	} else {
+		parts.BeginsSpace = int((second.flag >> 2) & 1)
+		parts.SplitWord = -(int(first.flag & 1 & (second.flag >> 1)) * 103)
+	}
+	if alternative {
+		parts.Shorter = -(branchless.LessThan(branchLength, length) * 100)
+		parts.SameLength = -(branchless.Equal(branchLength, length) * 10000)
+	}
+	return parts
+}
+
+// --------- ENCODER ---------
+
+const (
+	encoderReadSize = 1024 * 64 // bytes read from the io.Reader at a time
+	encoderMaxSegment = 1024 * 1024 // if there is no newline within this many bytes, a space is used to segment instead
+)
+
+// Creates a new Encoder instance.
+// This is for tokenizing text from an io.Reader without loading all of it into memory.
+// The tokens produced are identical to those produced by the Vocab's Tokenize method on the same text.
+func (vocab *Vocab) NewEncoder(reader io.Reader) *Encoder {
+	return &Encoder{vocab:*vocab, reader:reader}
+}
+
+// Returns the next batch of tokens from the stream.
+// The 2nd returned value is io.EOF once the stream has been fully tokenized, or any other error from reading or normalizing.
+func (e *Encoder) Next() ([]uint32, error) {
+	var tokens []uint32
+	var missing, consumed int
+	for !e.done {
+		if e.vocab.maxTokenLength == 0 {
+			e.done = true
+			break
+		}
+		if !e.eof {
+			if err := e.fill(); err != nil {
+				return nil, err
+			}
+		}
+		// Normalize everything up to the last point that is safe to segment the text
+		cut := len(e.raw)
+		if !e.eof {
+			cut = streamSegment(e.raw, e.vocab.charset)
+		}
+		if cut > 0 {
+			normalized, err := e.vocab.normalizeSegment(e.raw[:cut], !e.started, e.eof && cut == len(e.raw))
+			if err != nil {
+				return nil, err
+			}
+			e.started = true
+			e.normalized = append(e.normalized, normalized...)
+			e.raw = e.raw[:copy(e.raw, e.raw[cut:])]
+		}
+		// Tokenize everything that has enough data after it for the lookahead
+		final := e.eof && len(e.raw) == 0
+		tokens, missing, consumed = e.vocab.tokenizeStream(e.normalized, make([]uint32, 0, (len(e.normalized) / 4) + 4), &e.state, final)
+		e.missing += missing
+		e.normalized = e.normalized[:copy(e.normalized, e.normalized[consumed:])]
+		if final {
+			e.done = true
+		}
+		if len(tokens) > 0 {
+			return tokens, nil
+		}
+	}
+	return nil, io.EOF
+}
+
+// Reads the entire stream and returns all of the tokens.
+func (e *Encoder) ReadAll() ([]uint32, error) {
+	var all []uint32
+	for {
+		tokens, err := e.Next()
+		all = append(all, tokens...)
+		if err == io.EOF {
+			return all, nil
+		}
+		if err != nil {
+			return all, err
+		}
+	}
+}
+
+// The number of characters so far for which there were no tokens and were replaced with Unk token.
+func (e *Encoder) Missing() int {
+	return e.missing
+}
+
+func (e *Encoder) fill() error {
+	if cap(e.raw) - len(e.raw) < encoderReadSize {
+		raw := make([]byte, len(e.raw), (len(e.raw) * 2) + encoderReadSize)
+		copy(raw, e.raw)
+		e.raw = raw
+	}
+	n, err := e.reader.Read(e.raw[len(e.raw) : len(e.raw) + encoderReadSize])
+	e.raw = e.raw[0 : len(e.raw) + n]
+	if err == io.EOF {
+		e.eof = true
+		return nil
+	}
+	return err
+}
+
+// Returns the position of the last point at which the text can be split and normalized separately, or 0.
+// This is the beginning of a line, or if there isn't one within encoderMaxSegment, then the beginning of a space.
+func streamSegment(b []byte, charset uint8) int {
+	if charset == 2 { // UTF-16 is split only on 16-bit boundaries
+		var c0, c1 uint16
+		for i := (len(b) - 2) &^ 1; i >= 2; i -= 2 {
+			c0 = binary.LittleEndian.Uint16(b[i-2:])
+			c1 = binary.LittleEndian.Uint16(b[i:])
+			if c0 == '\n' && (c1 == '\n' || (c1 > 32 && c1 < 128)) {
+				return i
+			}
+		}
+		if len(b) > encoderMaxSegment {
+			for i := (len(b) - 2) &^ 1; i >= 2; i -= 2 {
+				c0 = binary.LittleEndian.Uint16(b[i-2:])
+				c1 = binary.LittleEndian.Uint16(b[i:])
+				if c1 == ' ' && c0 > 32 && c0 < 128 {
+					return i
+				}
+			}
+		}
+		return 0
+	}
+	for i := len(b) - 1; i >= 1; i-- {
+		if b[i-1] == '\n' && (b[i] == '\n' || (b[i] > 32 && b[i] < 128)) {
+			return i
+		}
+	}
+	if len(b) > encoderMaxSegment {
+		for i := len(b) - 1; i >= 1; i-- {
+			if b[i] == ' ' && b[i-1] > 32 && b[i-1] < 128 {
+				return i
+			}
+		}
+	}
+	return 0
+}
 
-		} else { // !found
-			if vocab.unkToken != DOES_NOT_EXIST {
-				index = vocab.unkToken
-				buffer = append(buffer, uint8(index), uint8(index >> 8), uint8(index >> 16), 0)
+// Tokenizes as far as possible without being affected by data beyond the end, unless it's the final part of the stream.
+// This is tokenize built on branches, so that it can stop at any position and resume from `state` with more data.
+// The 3rd returned value is the number of bytes of data that were consumed.
+func (vocab Vocab) tokenizeStream(data []byte, tokens []uint32, state *streamState, final bool) ([]uint32, int, int) {
+	var i, length, forwardDelete, missing, best, k int
+	var index uint32
+	var found bool
+	var list []branch
+
+	// Resume with the longest match that the previous call found at the position where it stopped
+	matched := state.pending
+	if matched {
+		index, length, forwardDelete = state.index, state.length, state.forwardDelete
+		state.pending = false
+	}
+
+	lilbuf := make([]byte, vocab.maxTokenLength)
+	lilbuf[0] = 32
+
+	// Unless this is the end of the stream, stop when there is no longer enough data for the lookahead,
+	// which is the longest match, the longest match after it, and 1 byte after that
+	lenData := len(data)
+	limit := lenData - (vocab.maxTokenLength * 2) - 1
+	if final {
+		// Add 1 extra byte to the end because we look ahead 1 byte
+		data = append(data, 0)
+		limit = lenData
+	}
+
+	for i < lenData {
+		if i > limit {
+			if matched { // the match was found with full lookahead, so hold onto it for next time
+				state.index, state.length, state.forwardDelete, state.pending = index, length, forwardDelete, true
 			}
-			i++
-			missing++
+			break
+		}
+		if !matched {
+			if index, length, found = vocab.dictionary.LongestSubstring(data[ i : i + branchless.Min(lenData - i, vocab.maxTokenLength) ]); !found {
+				if vocab.unkToken != DOES_NOT_EXIST {
+					tokens = append(tokens, vocab.unkToken)
+				}
+				i++
+				missing++
+				forwardDelete = 0
+				continue
+			}
+		}
+		list = vocab.branches(data, lenData, lilbuf, i, length, index, forwardDelete, list[:0])
+		if len(list) == 0 {
+			tokens = append(tokens, vocab.info[index].alt.id)
+			i += length // forwardDelete is already applied to length
 			forwardDelete = 0
+			matched = false
+			continue
+		}
+		// The first of the highest scoring branches is chosen, as in tokenize
+		best = 0
+		for k = range list {
+			if list[k].score > list[best].score {
+				best = k
+			}
 		}
+		tokens = append(tokens, list[best].tokens[:list[best].nTokens]...)
+		i += list[best].advance
+		length = list[best].length
+		index = list[best].index
+		forwardDelete = list[best].forwardDelete
+		matched = true
 	}
-	
-	return buffer, missing
+	return tokens, missing, i
 }
 
 // --------- GENERAL FUNCTIONS ---------
@@ -2604,9 +4393,39 @@ func (vocab Vocab) Save(outputFilename string) error {
 	if err != nil {
 		return err
 	}
-	defer fi.Close()
-	w := custom.NewWriter(fi)
-	defer w.Close()
+	if _, err = vocab.WriteTo(fi); err != nil {
+		fi.Close()
+		return err
+	}
+	return fi.Close()
+}
+
+// Counts the bytes written, for WriteTo.
+// It also hides the Close method of the underlying writer.
+type countingWriter struct {
+	w	io.Writer
+	n	int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Writes the vocabulary in the same format as Save, and returns the number of bytes written.
+// The writer is not closed.
+// The format is the 4 byte magic, uint32 version, the vocabulary, and then the CRC32 (IEEE) of the vocabulary.
+func (vocab *Vocab) WriteTo(writer io.Writer) (int64, error) {
+	cw := &countingWriter{w: writer}
+	header := make([]byte, 8)
+	copy(header, vocabMagic)
+	binary.LittleEndian.PutUint32(header[4:], vocabVersion)
+	if _, err := cw.Write(header); err != nil {
+		return cw.n, err
+	}
+	checksum := crc32.NewIEEE()
+	w := custom.NewWriter(io.MultiWriter(cw, checksum))
 
 	w.WriteByte(vocab.usingCapcode)
 	w.WriteByte(vocab.charset)
@@ -2634,7 +4453,7 @@ func (vocab Vocab) Save(outputFilename string) error {
 		w.WriteUint24(token.alt.id)
 		// The index of the token should always be less than the current index (because the list is sorted), check this is true
 		if (token.alt.index > uint32(i) && token.alt.index != DOES_NOT_EXIST) || (token.alt.index2 > uint32(i) && token.alt.index2 != DOES_NOT_EXIST) {
-			return errors.New(`Vocabulary is corrupt and cannot be saved`)
+			return cw.n, errors.New(`Vocabulary is corrupt and cannot be saved`)
 		}
 		w.WriteFloat32(token.score)
 	}
@@ -2649,20 +4468,65 @@ func (vocab Vocab) Save(outputFilename string) error {
 		w.WriteUint24(deleted.id)
 		w.WriteFloat32(deleted.score)
 	}
-	return nil
+	if err := w.Close(); err != nil {
+		return cw.n, err
+	}
+	binary.LittleEndian.PutUint32(header, checksum.Sum32())
+	_, err := cw.Write(header[0:4])
+	return cw.n, err
 }
 
 // Load the vocabulary from a local file.
 func Load(filename string) (*Vocab, error) {
-	var token tokenInfo
-	var key []byte
-	var res Vocab
 	fi, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
 	defer fi.Close()
-	r := custom.NewReader(fi)
+	return LoadFrom(fi)
+}
+
+// Load the vocabulary from a file within a filesystem, such as embed.FS.
+func LoadFS(fsys fs.FS, filename string) (*Vocab, error) {
+	fi, err := fsys.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+	return LoadFrom(fi)
+}
+
+// Load the vocabulary from a reader, which must contain only the vocabulary as saved by Save or WriteTo.
+// It reads until EOF.
+// Returns ErrBadMagic, ErrUnsupportedVersion or ErrChecksum if the file is not a vocabulary or is corrupt.
+func LoadFrom(reader io.Reader) (*Vocab, error) {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) >= 4 && string(data[0:4]) == vocabMagic {
+		if len(data) < 12 {
+			return nil, ErrChecksum
+		}
+		if binary.LittleEndian.Uint32(data[4:]) != vocabVersion {
+			return nil, ErrUnsupportedVersion
+		}
+		if crc32.ChecksumIEEE(data[8:len(data) - 4]) != binary.LittleEndian.Uint32(data[len(data) - 4:]) {
+			return nil, ErrChecksum
+		}
+		data = data[8:len(data) - 4]
+	} else if len(data) == 0 || data[0] > 2 { // vocabularies without the header begin with usingCapcode
+		return nil, ErrBadMagic
+	}
+	return loadVocab(data)
+}
+
+// Parses the vocabulary, after the header has been removed.
+func loadVocab(data []byte) (*Vocab, error) {
+	var token tokenInfo
+	var key []byte
+	var res Vocab
+	r := custom.NewReader(bytes.NewReader(data))
 	res.usingCapcode = r.ReadByte()
 	res.charset = r.ReadByte()
 	res.normalizer.Flag = r.ReadByte()
@@ -2685,7 +4549,7 @@ func Load(filename string) (*Vocab, error) {
 
 	res.info = make([]tokenInfo, nInfo)
 	res.reverse = make([][]byte, nReverse)
-	res.dictionary = new(pansearch.Fast)
+	dictionary := new(pansearch.Fast)
 	lengths := make([]int, nInfo)
 
 	for i:=0; i<nInfo; i++ {
@@ -2696,20 +4560,27 @@ func Load(filename string) (*Vocab, error) {
 			return nil, errors.New(`Not a valid TokenMonster vocabulary.`)
 		}
 		token.token = key
-		res.dictionary.Add(key)
+		dictionary.Add(key)
 		token.alt.data.flag = r.ReadByte()
 		token.alt.data.nWords = r.ReadByte()
 		token.alt.index = r.ReadUint24()
+		token.alt.index2 = r.ReadUint24()
+		// Alternatives always come before the token, because the list is sorted
+		if (token.alt.index >= uint32(i) && token.alt.index != DOES_NOT_EXIST) || (token.alt.index2 >= uint32(i) && token.alt.index2 != DOES_NOT_EXIST) {
+			return nil, errors.New(`Not a valid TokenMonster vocabulary.`)
+		}
 		if token.alt.index != DOES_NOT_EXIST {
 			token.alt.length = lengths[token.alt.index]
 			token.alt.id1 = res.info[token.alt.index].alt.id
 		}
-		token.alt.index2 = r.ReadUint24()
 		if token.alt.index2 != DOES_NOT_EXIST {
 			token.alt.length2 = lengths[token.alt.index2]
 			token.alt.id2 = res.info[token.alt.index2].alt.id
 		}
 		token.alt.id = r.ReadUint24()
+		if token.alt.id >= nReverse {
+			return nil, errors.New(`Not a valid TokenMonster vocabulary.`)
+		}
 		token.score = r.ReadFloat32()
 		res.info[i] = token
 		res.reverse[token.alt.id] = key
@@ -2731,15 +4602,297 @@ func Load(filename string) (*Vocab, error) {
 	if r.EOF() != nil {
 		return nil, errors.New(`Not a valid TokenMonster vocabulary.`)
 	}
-	res.dictionary.Build()
+	dictionary.Build()
+	res.dictionary = dictionary
+	return &res, nil
+}
+
+// Save the vocabulary to local file in the format for LoadMmap.
+// This is a different format to Save, it's larger because it includes the prebuilt lookup table.
+// All values are little-endian and each section is 8-byte aligned. The header ends with a CRC32 of the header fields before it and everything after the header.
+// After the 64 byte header are the sections:
+// beginByte [256]uint8, info [nInfo]{tokenOffset uint32, score float32, index, index2, id uint32, length, flag, nWords, 0 uint8},
+// deleted [nDeleted]{tokenOffset, id uint32, score float32, length uint8, 0, 0, 0}, hash table [tableSize]uint32 (info index + 1),
+// longest token for each beginning 2 bytes [65536]uint8, and then the bytes of all tokens.
+func (vocab *Vocab) SaveMmap(outputFilename string) error {
+	var nBytes int
+	for _, token := range vocab.info {
+		nBytes += len(token.token)
+	}
+	for _, deleted := range vocab.deleted {
+		nBytes += len(deleted.token)
+	}
+	tableSize := 1024
+	for tableSize < len(vocab.info) * 2 {
+		tableSize *= 2
+	}
+	offsets := mmapOffsets(len(vocab.info), len(vocab.deleted), tableSize)
+	b := make([]byte, offsets[5] + nBytes)
+	copy(b, mmapMagic)
+	binary.LittleEndian.PutUint32(b[8:], mmapVersion)
+	b[12], b[13], b[14], b[15], b[16], b[17] = vocab.usingCapcode, vocab.charset, vocab.normalizer.Flag, vocab.level, vocab.reserve, uint8(vocab.maxTokenLength)
+	for i, v := range []uint32{uint32(vocab.vocabSize), uint32(len(vocab.reverse)), uint32(len(vocab.info)), vocab.unkToken, vocab.deleteToken, uint32(len(vocab.deleted)), uint32(tableSize), uint32(nBytes)} {
+		binary.LittleEndian.PutUint32(b[20 + (i * 4):], v)
+	}
+	copy(b[offsets[0]:], vocab.beginByte[:])
+	table := b[offsets[3]:offsets[4]]
+	prefixes := b[offsets[4]:offsets[5]]
+	on := offsets[5]
+	for i, token := range vocab.info {
+		rec := b[offsets[1] + (i * mmapInfoSize):]
+		binary.LittleEndian.PutUint32(rec, uint32(on - offsets[5]))
+		binary.LittleEndian.PutUint32(rec[4:], math.Float32bits(token.score))
+		binary.LittleEndian.PutUint32(rec[8:], token.alt.index)
+		binary.LittleEndian.PutUint32(rec[12:], token.alt.index2)
+		binary.LittleEndian.PutUint32(rec[16:], token.alt.id)
+		rec[20], rec[21], rec[22] = uint8(len(token.token)), token.alt.data.flag, token.alt.data.nWords
+		on += copy(b[on:], token.token)
+		// Add to the hash table
+		for slot := mmapHash(token.token) & uint32(tableSize - 1); ; slot = (slot + 1) & uint32(tableSize - 1) {
+			if binary.LittleEndian.Uint32(table[slot * 4:]) == 0 {
+				binary.LittleEndian.PutUint32(table[slot * 4:], uint32(i + 1))
+				break
+			}
+		}
+		if len(token.token) >= 2 {
+			key := int(token.token[0]) | (int(token.token[1]) << 8)
+			prefixes[key] = uint8(branchless.Max(int(prefixes[key]), len(token.token)))
+		}
+	}
+	for i, deleted := range vocab.deleted {
+		rec := b[offsets[2] + (i * mmapDeletedSize):]
+		binary.LittleEndian.PutUint32(rec, uint32(on - offsets[5]))
+		binary.LittleEndian.PutUint32(rec[4:], deleted.id)
+		binary.LittleEndian.PutUint32(rec[8:], math.Float32bits(deleted.score))
+		rec[12] = uint8(len(deleted.token))
+		on += copy(b[on:], deleted.token)
+	}
+	binary.LittleEndian.PutUint32(b[52:], mmapChecksum(b))
+	return os.WriteFile(outputFilename, b, 0644)
+}
+
+// Load a vocabulary saved with SaveMmap by memory mapping the file.
+// The token bytes and the lookup table are used directly from the mapping, so loading is fast and the memory is shared between processes.
+// The vocabulary is read-only, the functions that modify a vocabulary have no effect on it. Use Close to release the mapping when the vocabulary is no longer used.
+// On platforms without mmap the file is read into memory instead.
+// Returns ErrBadMagic, ErrUnsupportedVersion or ErrChecksum if the file is not a memory mapped vocabulary or is corrupt.
+func LoadMmap(filename string) (*Vocab, error) {
+	b, err := mmapFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	res, err := loadMapped(b)
+	if err != nil {
+		munmapFile(b)
+		return nil, err
+	}
+	return res, nil
+}
+
+// Releases the memory mapping of a vocabulary loaded with LoadMmap, after which the vocabulary must not be used.
+// Decoders and Encoders made from the vocabulary hold a copy of it that still points into the mapping, so they must not be used after Close either.
+// This does nothing for vocabularies not loaded with LoadMmap.
+func (vocab *Vocab) Close() error {
+	if vocab.mapping == nil {
+		return nil
+	}
+	err := munmapFile(vocab.mapping)
+	vocab.mapping = nil
+	vocab.dictionary = nil
+	vocab.info = nil
+	vocab.reverse = nil
+	vocab.deleted = nil
+	return err
+}
+
+func loadMapped(b []byte) (*Vocab, error) {
+	invalid := errors.New(`Not a valid TokenMonster memory mapped vocabulary.`)
+	if len(b) < mmapHeaderSize || string(b[0:8]) != mmapMagic {
+		return nil, ErrBadMagic
+	}
+	if binary.LittleEndian.Uint32(b[8:]) != mmapVersion {
+		return nil, ErrUnsupportedVersion
+	}
+	if binary.LittleEndian.Uint32(b[52:]) != mmapChecksum(b) {
+		return nil, ErrChecksum
+	}
+	var res Vocab
+	res.usingCapcode, res.charset, res.normalizer.Flag, res.level, res.reserve, res.maxTokenLength = b[12], b[13], b[14], b[15], b[16], int(b[17])
+	header := make([]int, 8)
+	for i := range header {
+		header[i] = int(binary.LittleEndian.Uint32(b[20 + (i * 4):]))
+	}
+	nReverse, nInfo, nDeleted, tableSize, nBytes := header[1], header[2], header[5], header[6], header[7]
+	res.vocabSize, res.unkToken, res.deleteToken = header[0], uint32(header[3]), uint32(header[4])
+	if res.charset > 2 || res.usingCapcode > 2 || tableSize == 0 || tableSize & (tableSize - 1) != 0 || tableSize <= nInfo {
+		return nil, invalid
+	}
+	offsets := mmapOffsets(nInfo, nDeleted, tableSize)
+	if len(b) != offsets[5] + nBytes {
+		return nil, invalid
+	}
+	tokens := b[offsets[5]:]
+	copy(res.beginByte[:], b[offsets[0]:])
+	res.info = make([]tokenInfo, nInfo)
+	res.reverse = make([][]byte, nReverse)
+	var start, length int
+	for i := range res.info {
+		rec := b[offsets[1] + (i * mmapInfoSize):]
+		start, length = int(binary.LittleEndian.Uint32(rec)), int(rec[20])
+		if start + length > nBytes {
+			return nil, invalid
+		}
+		token := &res.info[i]
+		token.token = tokens[start : start + length : start + length]
+		token.score = math.Float32frombits(binary.LittleEndian.Uint32(rec[4:]))
+		token.alt.index = binary.LittleEndian.Uint32(rec[8:])
+		token.alt.index2 = binary.LittleEndian.Uint32(rec[12:])
+		token.alt.id = binary.LittleEndian.Uint32(rec[16:])
+		token.alt.data.flag, token.alt.data.nWords = rec[21], rec[22]
+		if int(token.alt.id) >= nReverse || (int(token.alt.index) >= nInfo && token.alt.index != DOES_NOT_EXIST) || (int(token.alt.index2) >= nInfo && token.alt.index2 != DOES_NOT_EXIST) {
+			return nil, invalid
+		}
+		res.reverse[token.alt.id] = token.token
+	}
+	for i := range res.info {
+		token := &res.info[i]
+		if token.alt.index != DOES_NOT_EXIST {
+			token.alt.length = len(res.info[token.alt.index].token)
+			token.alt.id1 = res.info[token.alt.index].alt.id
+		}
+		if token.alt.index2 != DOES_NOT_EXIST {
+			token.alt.length2 = len(res.info[token.alt.index2].token)
+			token.alt.id2 = res.info[token.alt.index2].alt.id
+		}
+	}
+	if nDeleted > 0 {
+		res.deleted = make([]deletedStruct, nDeleted)
+		for i := range res.deleted {
+			rec := b[offsets[2] + (i * mmapDeletedSize):]
+			start, length = int(binary.LittleEndian.Uint32(rec)), int(rec[12])
+			if start + length > nBytes {
+				return nil, invalid
+			}
+			res.deleted[i] = deletedStruct{token:tokens[start : start + length : start + length], id:binary.LittleEndian.Uint32(rec[4:]), score:math.Float32frombits(binary.LittleEndian.Uint32(rec[8:]))}
+		}
+	}
+	dictionary := &mmapDictionary{info:res.info, prefixes:b[offsets[4]:offsets[5]], mask:uint32(tableSize - 1)}
+	table := b[offsets[3]:offsets[4]]
+	if isLittleEndian {
+		dictionary.table = unsafe.Slice((*uint32)(unsafe.Pointer(&table[0])), tableSize)
+	} else {
+		dictionary.table = make([]uint32, tableSize)
+		for i := range dictionary.table {
+			dictionary.table[i] = binary.LittleEndian.Uint32(table[i * 4:])
+		}
+	}
+	var used int
+	for _, v := range dictionary.table {
+		if int(v) > nInfo {
+			return nil, invalid
+		}
+		if v != 0 {
+			used++
+		}
+	}
+	if used >= tableSize { // a lookup of a key that's not there only stops at an empty slot
+		return nil, invalid
+	}
+	res.dictionary = dictionary
+	res.mapping = b
 	return &res, nil
 }
 
+// Returns the offsets of the sections of the SaveMmap format, beginning with beginByte and ending with the token bytes.
+func mmapOffsets(nInfo int, nDeleted int, tableSize int) []int {
+	align := func(i int) int {
+		return (i + 7) &^ 7
+	}
+	offsets := make([]int, 6)
+	offsets[0] = mmapHeaderSize
+	offsets[1] = offsets[0] + 256
+	offsets[2] = align(offsets[1] + (nInfo * mmapInfoSize))
+	offsets[3] = align(offsets[2] + (nDeleted * mmapDeletedSize))
+	offsets[4] = offsets[3] + (tableSize * 4)
+	offsets[5] = offsets[4] + 65536
+	return offsets
+}
+
+// The CRC32 of the header fields and everything after the header.
+func mmapChecksum(b []byte) uint32 {
+	crc := crc32.ChecksumIEEE(b[8:52])
+	return crc32.Update(crc, crc32.IEEETable, b[mmapHeaderSize:])
+}
+
+// FNV-1a
+func mmapHash(key []byte) uint32 {
+	var h uint32 = 2166136261
+	for _, c := range key {
+		h = (h ^ uint32(c)) * 16777619
+	}
+	return h
+}
+
+// The lookup table for a vocabulary loaded with LoadMmap.
+// It's a hash table of the tokens, and the length of the longest token for each first 2 bytes so it knows which lengths to look for.
+type mmapDictionary struct {
+	info		[]tokenInfo
+	table		[]uint32	// index of the token in info + 1, or 0 for an empty slot
+	prefixes	[]uint8
+	mask		uint32
+}
+
+func (d *mmapDictionary) find(key []byte, h uint32) (uint32, bool) {
+	var v uint32
+	for slot := h & d.mask; ; slot = (slot + 1) & d.mask {
+		if v = d.table[slot]; v == 0 {
+			return 0, false
+		}
+		if bytes.Equal(d.info[v - 1].token, key) {
+			return v - 1, true
+		}
+	}
+}
+
+// Returns the index of the token that exactly matches the key.
+func (d *mmapDictionary) Find(key []byte) (uint32, bool) {
+	return d.find(key, mmapHash(key))
+}
+
+// Returns the index and length of the longest token that the key begins with.
+func (d *mmapDictionary) LongestSubstring(key []byte) (uint32, int, bool) {
+	if len(key) == 0 {
+		return 0, 0, false
+	}
+	var hashes [256]uint32
+	var h uint32 = 2166136261
+	var index uint32
+	var found bool
+	longest := 1
+	if len(key) >= 2 {
+		longest = branchless.Min(int(d.prefixes[int(key[0]) | (int(key[1]) << 8)]), len(key))
+	}
+	for i := 0; i < longest || i == 0; i++ {
+		h = (h ^ uint32(key[i])) * 16777619
+		hashes[i] = h
+	}
+	for l := longest; l >= 2; l-- {
+		if index, found = d.find(key[:l], hashes[l - 1]); found {
+			return index, l, true
+		}
+	}
+	if index, found = d.find(key[:1], hashes[0]); found {
+		return index, 1, true
+	}
+	return 0, 0, false
+}
+
 // --------- GENERATE & MODIFY ---------
 
 // NewVocab makes a fresh vocabulary from a custom list of tokens.
 // If you generated your vocabulary with TokenMonster tools, you will not be using this function but instead using `Load`.
-func NewVocab(tokens [][]byte, specialTokens [][]byte, charset uint8, normalization string, usingCapcode uint8, include256bytes bool, include128bytes bool, includeUTF8bytes bool, includeASCIIbytes bool, includeExtendedBytes bool, excludeOtherBytes bool) (*Vocab, error) {
+// byteFallback enables byte fallback, as EnableByteFallback.
+func NewVocab(tokens [][]byte, specialTokens [][]byte, charset uint8, normalization string, usingCapcode uint8, include256bytes bool, include128bytes bool, includeUTF8bytes bool, includeASCIIbytes bool, includeExtendedBytes bool, excludeOtherBytes bool, byteFallback bool) (*Vocab, error) {
 	var reserve uint8
 	if include256bytes {
 		reserve |= 1 << 0
@@ -2759,6 +4912,9 @@ func NewVocab(tokens [][]byte, specialTokens [][]byte, charset uint8, normalizat
 	if excludeOtherBytes {
 		reserve |= 1 << 5
 	}
+	if byteFallback {
+		reserve |= 1 << 6
+	}
 	vocab := new(Vocab)
 	err := vocab.PrivateGenerateVocab(nil, nil, nil, tokens, nil, specialTokens, nil, charset, normalization, usingCapcode, 5, reserve, 0, true)
 	return vocab, err
@@ -2774,8 +4930,9 @@ func NewVocabFromYAML(yml []byte) (*Vocab, error) {
 // Adds a single token to the vocabulary.
 // Modifying a vocabulary does not change existing token IDs.
 // All normalization and capcode is applied automatically.
-func (vocab *Vocab) AddToken(token []byte) {
-	vocab.PrivateGenerateVocab(nil, nil, nil, [][]byte{token}, nil, nil, nil, 0, ``, 0, 0, 0, 0, false)
+// Returns an error if the vocabulary can't be modified, or if the result would not be valid, in which case the vocabulary is left as it was.
+func (vocab *Vocab) AddToken(token []byte) error {
+	return vocab.PrivateGenerateVocab(nil, nil, nil, [][]byte{token}, nil, nil, nil, 0, ``, 0, 0, 0, 0, false)
 }
 
 // Adds a single special token to the vocabulary.
@@ -2783,71 +4940,81 @@ func (vocab *Vocab) AddToken(token []byte) {
 // If any regular tokens contain your special token within them, they will be deleted.
 // Modifying a vocabulary does not change existing token IDs.
 // All normalization and capcode is applied automatically.
-func (vocab *Vocab) AddSpecialToken(token []byte) {
-	vocab.PrivateGenerateVocab(nil, nil, nil, nil, nil, [][]byte{token}, nil, 0, ``, 0, 0, 0, 0, false)
+// Returns an error if the vocabulary can't be modified, or if the result would not be valid, in which case the vocabulary is left as it was.
+func (vocab *Vocab) AddSpecialToken(token []byte) error {
+	return vocab.PrivateGenerateVocab(nil, nil, nil, nil, nil, [][]byte{token}, nil, 0, ``, 0, 0, 0, 0, false)
 }
 
 // Deletes a single token from the vocabulary.
 // Tokens to delete can be capcoded encoded or not, it will look for both.
 // Modifying a vocabulary does not change existing token IDs.
-func (vocab *Vocab) DeleteToken(token []byte) {
-	vocab.PrivateGenerateVocab(nil, nil, nil, nil, [][]byte{token}, nil, nil, 0, ``, 0, 0, 0, 0, false)
+// Returns an error if the vocabulary can't be modified, or if the result would not be valid, in which case the vocabulary is left as it was.
+func (vocab *Vocab) DeleteToken(token []byte) error {
+	return vocab.PrivateGenerateVocab(nil, nil, nil, nil, [][]byte{token}, nil, nil, 0, ``, 0, 0, 0, 0, false)
 }
 
 // Deletes a single token from the vocabulary by specifying the ID.
 // Modifying a vocabulary does not change existing token IDs.
-func (vocab *Vocab) DeleteTokenID(id uint32) {
+// Returns an error if the vocabulary can't be modified, or if the result would not be valid, in which case the vocabulary is left as it was.
+func (vocab *Vocab) DeleteTokenID(id uint32) error {
 	yml := []byte("delete:\n  - id: " + conv.String(int(id)))
-	vocab.PrivateGenerateVocab(yml, nil, nil, nil, nil, nil, nil, 0, ``, 0, 0, 0, 0, false)
+	return vocab.PrivateGenerateVocab(yml, nil, nil, nil, nil, nil, nil, 0, ``, 0, 0, 0, 0, false)
 }
 
 // Resets all the IDs of the tokens to be assigned alphabetically, starting from 0, with no gaps.
-func (vocab *Vocab) ResetTokenIds(token []byte) {
-	vocab.PrivateGenerateVocab(nil, nil, nil, nil, nil, nil, nil, 0, ``, 0, 0, 0, 0, true)
+// Returns an error if the vocabulary can't be modified, or if the result would not be valid, in which case the vocabulary is left as it was.
+func (vocab *Vocab) ResetTokenIds(token []byte) error {
+	return vocab.PrivateGenerateVocab(nil, nil, nil, nil, nil, nil, nil, 0, ``, 0, 0, 0, 0, true)
 }
 
 // Adds multiple regular and optionally special tokens.
 // You can use `size` to resize the vocabulary to keep it at a specific size.
 // Enter `size` 0 to not resize.
 // Modifying a vocabulary does not change existing token IDs.
-func (vocab *Vocab) AddTokens(addTokens [][]byte, specialTokens [][]byte, size int) {
-	vocab.PrivateGenerateVocab(nil, nil, nil, addTokens, nil, specialTokens, nil, 0, ``, 0, 0, 0, size, false)
+// Returns an error if the vocabulary can't be modified, or if the result would not be valid, in which case the vocabulary is left as it was.
+func (vocab *Vocab) AddTokens(addTokens [][]byte, specialTokens [][]byte, size int) error {
+	return vocab.PrivateGenerateVocab(nil, nil, nil, addTokens, nil, specialTokens, nil, 0, ``, 0, 0, 0, size, false)
 }
 
 // Add multiple special tokens and optionally resize.
 // Enter `size` 0 to not resize.
 // Modifying a vocabulary does not change existing token IDs.
-func (vocab *Vocab) AddSpecialTokens(specialTokens [][]byte, size int) {
-	vocab.PrivateGenerateVocab(nil, nil, nil, nil, nil, specialTokens, nil, 0, ``, 0, 0, 0, size, false)
+// Returns an error if the vocabulary can't be modified, or if the result would not be valid, in which case the vocabulary is left as it was.
+func (vocab *Vocab) AddSpecialTokens(specialTokens [][]byte, size int) error {
+	return vocab.PrivateGenerateVocab(nil, nil, nil, nil, nil, specialTokens, nil, 0, ``, 0, 0, 0, size, false)
 }
 
 // Delete multiple tokens and optionally resize.
 // Tokens to delete can be capcoded encoded or not, it will look for both.
 // Enter `size` 0 to not resize.
 // Modifying a vocabulary does not change existing token IDs.
-func (vocab *Vocab) DeleteTokens(deleteTokens [][]byte, size int) {
-	vocab.PrivateGenerateVocab(nil, nil, nil, nil, deleteTokens, nil, nil, 0, ``, 0, 0, 0, size, false)
+// Returns an error if the vocabulary can't be modified, or if the result would not be valid, in which case the vocabulary is left as it was.
+func (vocab *Vocab) DeleteTokens(deleteTokens [][]byte, size int) error {
+	return vocab.PrivateGenerateVocab(nil, nil, nil, nil, deleteTokens, nil, nil, 0, ``, 0, 0, 0, size, false)
 }
 
 // Add regular & special tokens, delete tokens and resize, all in one.
 // Modifying a vocabulary does not change existing token IDs.
 // Pass resetTokenIds = true to ensure there are no gaps in the token IDs.
-func (vocab *Vocab) ModifyVocabulary(addTokens [][]byte, specialTokens [][]byte, deleteTokens [][]byte, size int, resetTokenIds bool) {
-	vocab.PrivateGenerateVocab(nil, nil, nil, addTokens, deleteTokens, specialTokens, nil, 0, ``, 0, 0, 0, size, resetTokenIds)
+// Returns an error if the vocabulary can't be modified, or if the result would not be valid, in which case the vocabulary is left as it was.
+func (vocab *Vocab) ModifyVocabulary(addTokens [][]byte, specialTokens [][]byte, deleteTokens [][]byte, size int, resetTokenIds bool) error {
+	return vocab.PrivateGenerateVocab(nil, nil, nil, addTokens, deleteTokens, specialTokens, nil, 0, ``, 0, 0, 0, size, resetTokenIds)
 }
 
 // Add regular & special tokens, delete tokens and resize, all in one.
 // Modifying a vocabulary does not change existing token IDs.
 // Pass resetTokenIds = true to ensure there are no gaps in the token IDs.
-func (vocab *Vocab) ModifyVocabularyFromYAML(yml []byte, size int, resetTokenIds bool) {
-	vocab.PrivateGenerateVocab(yml, nil, nil, nil, nil, nil, nil, 0, ``, 0, 0, 0, size, resetTokenIds)
+// Returns an error if the vocabulary can't be modified, or if the result would not be valid, in which case the vocabulary is left as it was.
+func (vocab *Vocab) ModifyVocabularyFromYAML(yml []byte, size int, resetTokenIds bool) error {
+	return vocab.PrivateGenerateVocab(yml, nil, nil, nil, nil, nil, nil, 0, ``, 0, 0, 0, size, resetTokenIds)
 }
 
 // Resize the vocabulary by deleting the worst scoring tokens.
 // You can also resize the vocabulary to be larger if any tokens have previously been deleted.
 // Modifying a vocabulary does not change existing token IDs.
-func (vocab *Vocab) Resize(size int) {
-	vocab.PrivateGenerateVocab(nil, nil, nil, nil, nil, nil, nil, 0, ``, 0, 0, 0, size, false)
+// Returns an error if the vocabulary can't be modified, or if the result would not be valid, in which case the vocabulary is left as it was.
+func (vocab *Vocab) Resize(size int) error {
+	return vocab.PrivateGenerateVocab(nil, nil, nil, nil, nil, nil, nil, 0, ``, 0, 0, 0, size, false)
 }
 
 // Enables the UNK token.
@@ -2879,6 +5046,44 @@ func (vocab *Vocab) EnableUnkToken() bool {
 	return true
 }
 
+// Enables byte fallback, which adds a token for every byte that can occur in the text after capcode (if not already there),
+// so that any text can be tokenized without UNK tokens. The single byte tokens are then kept however the vocabulary is modified.
+// The fallback is the single byte tokens themselves, there are no reserved IDs or escape tokens, so the vocabulary can grow by up to 256 tokens.
+// The IDs of existing tokens are not changed. The vocabulary is lossless if it also has no normalization, see IsLossless.
+// Returns an error if the vocabulary can't be modified, or if the result would not be valid, in which case the vocabulary is left as it was.
+func (vocab *Vocab) EnableByteFallback() error {
+	return vocab.PrivateGenerateVocab(nil, nil, nil, nil, nil, nil, nil, 0, ``, 0, 0, 1 << 6, 0, false)
+}
+
+// Disables byte fallback, the single byte tokens are not deleted but they can then be deleted.
+func (vocab *Vocab) DisableByteFallback() {
+	vocab.reserve &^= 1 << 6
+}
+
+// Returns true if byte fallback is enabled.
+func (vocab *Vocab) ByteFallback() bool {
+	return vocab.reserve & 64 != 0
+}
+
+// Returns true if decoding the tokens of any text gives back exactly that text.
+// This is the case if the vocabulary has no normalization and every byte that can occur in the text after capcode has a token,
+// which is ensured by byte fallback (or include-256-bytes).
+func (vocab *Vocab) IsLossless() bool {
+	if vocab.maxTokenLength == 0 || vocab.normalizer.Flag != 0 {
+		return false
+	}
+	required := make([]bool, 256)
+	gen256bytes(required, vocab.usingCapcode)
+	for i, v := range required {
+		if v {
+			if _, found := vocab.dictionary.Find([]byte{byte(i)}); !found {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 // Disables the UNK token.
 // Without an UNK token, a character that has no token to represent it will be ignored.
 func (vocab *Vocab) DisableUnkToken() {
@@ -2897,6 +5102,10 @@ func (vocab *Vocab) DisableUnkToken() {
 // Don't use this function, it's exported because it's used by the exportvocab tool.
 func (vocab *Vocab) PrivateGenerateVocab(yamlData []byte, tokens [][]byte, scores []float32, addTokens [][]byte, deleteTokens [][]byte, specialTokens [][]byte, specialTokensEncoded [][]byte, charset uint8, normalizeString string, usingCapcode uint8, level uint8, reserve uint8, resize int, resetTokenIds bool) error {
 
+	if vocab.mapping != nil {
+		return errors.New(`Vocabulary loaded with LoadMmap is read-only`)
+	}
+	backup := *vocab // the fields are replaced, not modified in place, so this is enough to put it back if the result is not valid
 	if len(vocab.info) == 0 && vocab.unkToken == 0 {
 		vocab.unkToken = DOES_NOT_EXIST
 	}
@@ -2942,6 +5151,9 @@ func (vocab *Vocab) PrivateGenerateVocab(yamlData []byte, tokens [][]byte, score
 		if y.ExcludeOtherBytes {
 			reserve |= 1 << 5
 		}
+		if y.ByteFallback {
+			reserve |= 1 << 6
+		}
 		if y.Unk {
 			enableUnk = true
 			if y.UnkId != nil {
@@ -2995,6 +5207,9 @@ func (vocab *Vocab) PrivateGenerateVocab(yamlData []byte, tokens [][]byte, score
 	}
 	excludeOtherBytes := (reserve & 32) != 0
 	vocab.reserve = vocab.reserve | reserve
+	if vocab.reserve & 64 != 0 { // byte fallback, the single byte tokens are kept however the vocabulary is modified
+		gen256bytes(charTable, usingCapcode)
+	}
 
 	specialMap := make(map[string]bool)
 	scoresMap := make(map[string]float32)
@@ -3488,11 +5703,10 @@ func (vocab *Vocab) PrivateGenerateVocab(yamlData []byte, tokens [][]byte, score
 	var beginByte [256][4]uint32
 	if dictionary.Reset() {
 		var token, subword []byte
-		var on, hasSuffix, length, minAltSize int
+		var on, hasSuffix, length, minAltSize, begin int
 		var r, r2 rune
-		var n, n2 int
-		var priority1, priority2, nWords uint8
-		var found, onlyLetterSpace, onlyNumberSpace, onlyPunc bool
+		var priority1, priority2 uint8
+		var found bool
 		var score float32
 		for eof := false; !eof; {
 			token, eof = dictionary.Next()
@@ -3511,86 +5725,8 @@ func (vocab *Vocab) PrivateGenerateVocab(yamlData []byte, tokens [][]byte, score
 			}
 			priority1 = 0
 			priority2 = 0
-			nWords = 0
-			minAltSize = 1
-			onlyLetterSpace = false
-			onlyNumberSpace = false
-			onlyPunc = false
-			r, n = decodeRune(token, charset)
-			r2, n2 = decodeRune(token[n:], charset)
-			// Check beginning of token
-			if r == ' ' {
-				tokenData.alt.data.flag = 4
-				beginByte[token[0]][0]++
-				if isAlphaNum(r2, usingCapcode) {
-					nWords++
-					minAltSize = 2
-				}
-			} else if isLetter(r, usingCapcode) {
-				tokenData.alt.data.flag = 2
-				beginByte[token[0]][1]++
-			} else if isCapcode(r, usingCapcode) {
-				if r == capcode.CharacterToken || r == capcode.WordToken {
-					tokenData.alt.data.flag = 4 // count as a space
-				}
-				tokenData.alt.data.flag |= 16 // begins on capcode
-				beginByte[token[0]][3]++
-			} else if unicode.IsNumber(r) {
-				beginByte[token[0]][2]++
-			} else {
-				beginByte[token[0]][3]++
-			}
-			// Count words in token
-			if len(token) == 1 {
-				onlyPunc = true
-			} else {
-				if (r == ' ' || isLetter(r, usingCapcode)) && isLetter(r2, usingCapcode) {
-					onlyLetterSpace = true
-				} else if (r == ' ' || unicode.IsNumber(r)) && unicode.IsNumber(r2) {
-					onlyNumberSpace = true
-				} else if !isAlphaNum(r, usingCapcode) && !isAlphaNum(r2, usingCapcode) {
-					onlyPunc = true
-				}
-				for i := n + n2; i < len(token); i += n2 {
-					r = r2
-					n = n2
-					r2, n2 = decodeRune(token[i:], charset)
-					if r == ' ' && isAlphaNum(r2, usingCapcode) {
-						nWords++
-					}
-					if isLetter(r2, usingCapcode) {
-						onlyPunc = false
-						onlyNumberSpace = false
-					} else if unicode.IsNumber(r2) {
-						onlyPunc = false
-						onlyLetterSpace = false
-					} else if r2 != ' ' {
-						onlyLetterSpace = false
-						onlyNumberSpace = false
-					}
-				}
-			}	
-			tokenData.alt.data.nWords = nWords
-			// Now do some precalculations concerning the token
-			r = decodeLastRune(token, charset)
-			if minAltSize == 2 && isLetter(r, usingCapcode) && onlyLetterSpace { // only letters and full words
-				if nWords == 1 {
-					tokenData.alt.data.flag |= 32 // 1 word beginning space with only letters
-				}
-			}
-			if minAltSize == 2 && nWords <= 1 { // begins _A and more than 1 word
-				minAltSize = 1
-			}
-			if isCapcode(r, usingCapcode) {
-				tokenData.alt.data.flag |= 8
-			}
-			// Check end of token
-			if isLetter(r, usingCapcode) { // token ends with a letter
-				tokenData.alt.data.flag |= 1
-			}
-			if onlyLetterSpace || onlyNumberSpace || onlyPunc {
-				tokenData.alt.data.flag |= 128
-			}
+			tokenData.alt.data.flag, tokenData.alt.data.nWords, begin, minAltSize = tokenFlags(token, charset, usingCapcode)
+			beginByte[token[0]][begin]++
 
 			hasSuffix = hasSuffixPos(ungreedySuffixesB, token, charset, usingCapcode)
 
@@ -3777,15 +5913,7 @@ func (vocab *Vocab) PrivateGenerateVocab(yamlData []byte, tokens [][]byte, score
 	}
 
 	// Build chartable
-	for i:=0; i<256; i++ {
-		if beginByte[i][1] > beginByte[i][0] && beginByte[i][1] > beginByte[i][2] && beginByte[i][1] > beginByte[i][3] && beginByte[i][1] > 2 {
-			vocab.beginByte[i] = 1 // it's a letter
-		} else if beginByte[i][0] > beginByte[i][1] && beginByte[i][0] > beginByte[i][2] && beginByte[i][0] > beginByte[i][3] && beginByte[i][0] > 2 {
-			vocab.beginByte[i] = 4 + 8 // it's a space
-		} else if beginByte[i][3] > beginByte[i][0] && beginByte[i][3] > beginByte[i][1] && beginByte[i][3] > beginByte[i][2] && beginByte[i][3] > 2 {
-			vocab.beginByte[i] = 2 + 8 // it's punctuation or capcode
-		}
-	}
+	vocab.beginByte = buildBeginByte(&beginByte)
 
 	// Set the deleteToken to it's ID instead of index
 	if vocab.deleteToken != DOES_NOT_EXIST {
@@ -3797,6 +5925,157 @@ func (vocab *Vocab) PrivateGenerateVocab(yamlData []byte, tokens [][]byte, score
 	if vocab.reserve == 0 {
 		vocab.reserve = displayReserve
 	}
+	if err = vocab.Validate(); err != nil {
+		*vocab = backup
+		return err
+	}
+	return nil
+}
+
+// Builds the chartable from the count of each type of character that tokens begin with for each byte.
+func buildBeginByte(beginByte *[256][4]uint32) [256]byte {
+	var res [256]byte
+	for i:=0; i<256; i++ {
+		if beginByte[i][1] > beginByte[i][0] && beginByte[i][1] > beginByte[i][2] && beginByte[i][1] > beginByte[i][3] && beginByte[i][1] > 2 {
+			res[i] = 1 // it's a letter
+		} else if beginByte[i][0] > beginByte[i][1] && beginByte[i][0] > beginByte[i][2] && beginByte[i][0] > beginByte[i][3] && beginByte[i][0] > 2 {
+			res[i] = 4 + 8 // it's a space
+		} else if beginByte[i][3] > beginByte[i][0] && beginByte[i][3] > beginByte[i][1] && beginByte[i][3] > beginByte[i][2] && beginByte[i][3] > 2 {
+			res[i] = 2 + 8 // it's punctuation or capcode
+		}
+	}
+	return res
+}
+
+// Checks that the vocabulary is consistent, and returns an error describing the first problem found.
+// This checks the token IDs, the alternatives of each token, the flags and the chartable.
+// It's run automatically after a vocabulary is generated or modified, and can be used to check a vocabulary after loading it.
+func (vocab *Vocab) Validate() error {
+	if vocab.usingCapcode > 2 || vocab.charset > 2 {
+		return errors.New(`Invalid capcode or charset`)
+	}
+	if vocab.dictionary == nil {
+		return errors.New(`Vocabulary has not been generated`)
+	}
+	var deleteByte byte
+	switch vocab.usingCapcode {
+		case 1:
+			deleteByte = capcode.NoCapcodeDeleteToken
+		case 2:
+			deleteByte = capcode.DeleteToken
+	}
+	canonical := make([][]byte, len(vocab.reverse)) // tokens beginning deleteToken then space share the ID of the token without it
+	matched := make([]bool, len(vocab.reverse))
+	var beginByte [256][4]uint32
+	var maxTokenLength, nIds, begin int
+	var flag, nWords uint8
+	var found bool
+	var index uint32
+	var s string
+	for i, token := range vocab.info {
+		s = strconv.Quote(string(token.token))
+		if len(token.token) == 0 || len(token.token) > 40 {
+			return errors.New(`Token has invalid length: ` + s)
+		}
+		if len(token.token) > maxTokenLength {
+			maxTokenLength = len(token.token)
+		}
+		if index, found = vocab.dictionary.Find(token.token); !found || index != uint32(i) {
+			return errors.New(`Token is not in the dictionary at its index: ` + s)
+		}
+		// Check the ID
+		id := token.alt.id
+		if int(id) >= len(vocab.reverse) || vocab.reverse[id] == nil {
+			return errors.New(`Token has an ID that is not in use: ` + s)
+		}
+		c := token.token
+		if deleteByte != 0 && len(c) > 2 && c[0] == deleteByte && c[1] == ' ' {
+			c = c[2:]
+		}
+		if canonical[id] == nil {
+			canonical[id] = c
+			nIds++
+		} else if !bytes.Equal(canonical[id], c) {
+			return errors.New(`Token has the same ID as another token: ` + s)
+		}
+		if bytes.Equal(vocab.reverse[id], token.token) {
+			matched[id] = true
+		}
+		// Check the flags
+		if token.alt.data.flag & 64 != 0 {
+			if token.alt.data.flag != 64 || token.alt.data.nWords != 0 || token.alt.index != DOES_NOT_EXIST || token.alt.index2 != DOES_NOT_EXIST {
+				return errors.New(`Special token has invalid flags or alternatives: ` + s)
+			}
+			continue
+		}
+		flag, nWords, begin, _ = tokenFlags(token.token, vocab.charset, vocab.usingCapcode)
+		if flag != token.alt.data.flag || nWords != token.alt.data.nWords {
+			return errors.New(`Token flags do not match the token: ` + s)
+		}
+		beginByte[token.token[0]][begin]++
+		// Check the alternatives
+		if token.alt.index == DOES_NOT_EXIST && token.alt.index2 != DOES_NOT_EXIST {
+			return errors.New(`Token has a second alternative without a first: ` + s)
+		}
+		for _, alt := range [2]struct{index uint32; length int; id uint32}{{token.alt.index, token.alt.length, token.alt.id1}, {token.alt.index2, token.alt.length2, token.alt.id2}} {
+			if alt.index == DOES_NOT_EXIST {
+				if alt.length != 0 {
+					return errors.New(`Token has an alternative length without an alternative: ` + s)
+				}
+				continue
+			}
+			if alt.index >= uint32(i) {
+				return errors.New(`Token has an alternative that is not a prefix of it: ` + s)
+			}
+			alternative := vocab.info[alt.index]
+			if len(alternative.token) >= len(token.token) || !bytes.HasPrefix(token.token, alternative.token) {
+				return errors.New(`Token has an alternative that is not a prefix of it: ` + s)
+			}
+			if alt.length != len(alternative.token) || alt.id != alternative.alt.id {
+				return errors.New(`Token has an alternative with the wrong length or ID: ` + s)
+			}
+		}
+	}
+	for id, token := range vocab.reverse {
+		if token != nil && !matched[id] {
+			return errors.New(`ID ` + conv.String(id) + ` does not match the token with that ID`)
+		}
+	}
+	if maxTokenLength != vocab.maxTokenLength {
+		return errors.New(`Maximum token length does not match the tokens`)
+	}
+	if vocab.unkToken != DOES_NOT_EXIST {
+		if int(vocab.unkToken) >= len(vocab.reverse) || vocab.reverse[vocab.unkToken] != nil {
+			return errors.New(`UNK token ID is out of range or used by another token`)
+		}
+		nIds++
+	}
+	if nIds != vocab.vocabSize {
+		return errors.New(`Vocabulary size does not match the number of token IDs`)
+	}
+	// The deleteToken must be set if and only if the vocabulary has the token for it
+	if deleteByte == 0 {
+		if vocab.deleteToken != DOES_NOT_EXIST {
+			return errors.New(`Vocabulary has a deleteToken but is not using capcode`)
+		}
+	} else {
+		if index, found = vocab.dictionary.Find([]byte{deleteByte}); found != (vocab.deleteToken != DOES_NOT_EXIST) || (found && vocab.info[index].alt.id != vocab.deleteToken) {
+			return errors.New(`deleteToken ID does not match the delete token`)
+		}
+	}
+	if buildBeginByte(&beginByte) != vocab.beginByte {
+		return errors.New(`Chartable does not match the tokens for the charset`)
+	}
+	// With byte fallback every byte that can occur must have a token
+	if vocab.reserve & 64 != 0 {
+		required := make([]bool, 256)
+		gen256bytes(required, vocab.usingCapcode)
+		for i, v := range required {
+			if _, found = vocab.dictionary.Find([]byte{byte(i)}); v && !found {
+				return errors.New(`Byte fallback is enabled but there is no token for byte ` + conv.String(i))
+			}
+		}
+	}
 	return nil
 }
 
@@ -3814,6 +6093,7 @@ type YamlVocab struct {
 	IncludeAsciiBytes    bool       `yaml:"include-ascii-bytes,omitempty"`
 	IncludeExtendedBytes bool       `yaml:"include-extended-bytes,omitempty"`
 	ExcludeOtherBytes    bool       `yaml:"exclude-other-bytes,omitempty"`
+	ByteFallback         bool       `yaml:"byte-fallback,omitempty"`
 	Unk                  bool       `yaml:"unk,omitempty"`
 	UnkId                *int        `yaml:"unk-id,omitempty"`
 	Regular              []YamlItem `yaml:"tokens,omitempty"`
@@ -3861,6 +6141,9 @@ func (vocab *Vocab) ExportYAML(writer io.Writer, orderByScore bool) {
 		case 2:
 			w.WriteString("capcode: 2\n")
 	}
+	if vocab.reserve & 64 != 0 {
+		w.WriteString("byte-fallback: true\n")
+	}
 	if vocab.level < 5 {
 		w.WriteString("training-param: ")
 		w.WriteInt(int((uint16(vocab.reserve) << 3) | uint16(vocab.level)))
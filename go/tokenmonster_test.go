@@ -0,0 +1,71 @@
+package tokenmonster
+
+import (
+	"io"
+	"bytes"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func testVocab(t *testing.T, usingCapcode uint8) *Vocab {
+	words := []string{`hello`, ` hello`, `hel`, `lo`, `world`, ` world`, ` wor`, `ld`, `the`, ` the`, ` quick`, `qu`, `ick`, ` brown`, ` fox`, ` jumps`, ` over`, ` lazy`, ` dog`, `.`, `, `,
+		` héllo`, ` wörld`, `ö`, `é`, `你好`, `你`, `😀`, ` 😀`, `test`, ` test`, `testing`, `ing`, `-`, `helloworld`}
+	tokens := make([][]byte, len(words))
+	for i, word := range words {
+		tokens[i] = []byte(word)
+	}
+	vocab, err := NewVocab(tokens, nil, 1, `none`, usingCapcode, false, false, false, false, false, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vocab
+}
+
+// The Encoder must produce the same tokens as Tokenize, however the text is split by the reads
+func TestEncoderMatchesTokenize(t *testing.T) {
+	lines := []string{
+		`Hello World, THE Quick Brown Fox jumps over the lazy dog.`,
+		`héllo wörld 你好 😀😀 HÉLLO WÖRLD Héllo`,
+		`testing Testing TESTING hello-world HelloWorld`,
+		strings.Repeat(`helloworld`, 40),
+		``,
+		strings.Repeat(`你好😀 `, 30),
+	}
+	var text []byte
+	for i := 0; i < 30; i++ {
+		text = append(text, lines[i % len(lines)]...)
+		text = append(text, '\n')
+	}
+	for _, usingCapcode := range []uint8{0, 1, 2} {
+		vocab := testVocab(t, usingCapcode)
+		expected, _, err := vocab.Tokenize(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readers := []struct {
+			name	string
+			reader	io.Reader
+		}{
+			{`one byte`, iotest.OneByteReader(bytes.NewReader(text))},
+			{`half`, iotest.HalfReader(bytes.NewReader(text))},
+			{`whole`, bytes.NewReader(text)},
+		}
+		for _, r := range readers {
+			tokens, err := vocab.NewEncoder(r.reader).ReadAll()
+			if err != nil {
+				t.Fatalf(`capcode %d, %s reads: %v`, usingCapcode, r.name, err)
+			}
+			if len(tokens) != len(expected) {
+				t.Errorf(`capcode %d, %s reads: %d tokens, Tokenize gave %d`, usingCapcode, r.name, len(tokens), len(expected))
+				continue
+			}
+			for i := range tokens {
+				if tokens[i] != expected[i] {
+					t.Errorf(`capcode %d, %s reads: token %d is %d, Tokenize gave %d`, usingCapcode, r.name, i, tokens[i], expected[i])
+					break
+				}
+			}
+		}
+	}
+}
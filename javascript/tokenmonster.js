@@ -349,7 +349,20 @@ class TokenMonster {
       }
       buffer = await response.arrayBuffer();
     }
-    const dataView = new DataView(buffer);
+    let dataView = new DataView(buffer);
+
+    // Vocabularies saved with a header begin with the magic "TMVB" and a uint32 version, and end with the CRC32 of the vocabulary
+    // Older vocabularies have no header and begin with the capcode byte
+    if (dataView.byteLength >= 4 && dataView.getUint32(0, false) === 0x544D5642) {
+      if (dataView.byteLength < 12 || dataView.getUint32(4, true) !== 1) {
+        throw new Error('Unsupported version of TokenMonster vocabulary file.');
+      }
+      const payload = new Uint8Array(dataView.buffer, dataView.byteOffset + 8, dataView.byteLength - 12);
+      if (crc32(payload) !== dataView.getUint32(dataView.byteLength - 4, true)) {
+        throw new Error('TokenMonster vocabulary file is corrupt, the checksum does not match.');
+      }
+      dataView = new DataView(dataView.buffer, dataView.byteOffset + 8, dataView.byteLength - 12);
+    }
 
     // Read capcode
     this.capcode = dataView.getUint8(0);
@@ -869,6 +882,17 @@ function incompleteUTF16Bytes(bytes) {
   return 0; // All bytes form complete UTF-16 characters
 }
 
+function crc32(bytes) {
+  let crc = 0xFFFFFFFF;
+  for (let i = 0; i < bytes.length; i++) {
+    crc ^= bytes[i];
+    for (let k = 0; k < 8; k++) {
+      crc = (crc & 1) ? (0xEDB88320 ^ (crc >>> 1)) : (crc >>> 1);
+    }
+  }
+  return (crc ^ 0xFFFFFFFF) >>> 0;
+}
+
 // ---- capcode.js ----
 
 const characterToken = 'C';
@@ -225,7 +225,10 @@ class Vocab:
             raise FileNotFoundError("TokenMonster: Unable to locate " + path)
         # Now read the vocabulary header
         with open(path, 'rb') as file:
-            vocab_header = file.read(17)
+            vocab_header = file.read(25)
+        # Vocabularies saved with a header begin with the magic "TMVB" and a uint32 version
+        if vocab_header[0:4] == b"TMVB":
+            vocab_header = vocab_header[8:]
         self._capcode = vocab_header[0]
         self._charset = vocab_header[1]
         self._normalization = vocab_header[2]
@@ -128,6 +128,21 @@ int incomplete_utf16_bytes(std::span<const std::uint8_t> bytes) {
   return 0;
 }
 
+std::uint32_t crc32(const std::uint8_t* data, std::size_t n) {
+  static const auto table = [] {
+    std::array<std::uint32_t, 256> t{};
+    for (std::uint32_t i = 0; i < 256; ++i) {
+      std::uint32_t c = i;
+      for (int k = 0; k < 8; ++k) c = (c & 1) != 0 ? 0xEDB88320U ^ (c >> 1) : c >> 1;
+      t[i] = c;
+    }
+    return t;
+  }();
+  std::uint32_t crc = 0xFFFFFFFFU;
+  for (std::size_t i = 0; i < n; ++i) crc = table[(crc ^ data[i]) & 0xFF] ^ (crc >> 8);
+  return crc ^ 0xFFFFFFFFU;
+}
+
 class Reader {
  public:
   explicit Reader(const std::filesystem::path& path) {
@@ -178,6 +193,24 @@ class Reader {
 
   bool eof() const { return at_ == data_.size(); }
 
+  // Vocabularies saved with a header begin with the magic "TMVB" and a uint32 version, and end with the
+  // CRC32 of the vocabulary. Older vocabularies have no header and begin with the capcode byte.
+  void read_header() {
+    if (data_.size() >= 4 && std::memcmp(data_.data(), "TMVB", 4) == 0) {
+      if (data_.size() < 12) throw Error("vocabulary checksum does not match");
+      at_ = 4;
+      if (read_uint32() != 1) throw Error("unsupported vocabulary file version");
+      auto end = data_.size() - 4;
+      at_ = end;
+      auto checksum = read_uint32();
+      if (crc32(data_.data() + 8, end - 8) != checksum) throw Error("vocabulary checksum does not match");
+      data_.resize(end);
+      at_ = 8;
+    } else if (data_.empty() || data_[0] > 2) {
+      throw Error("not a TokenMonster vocabulary file");
+    }
+  }
+
  private:
   void require(std::size_t n) const {
     if (at_ + n > data_.size()) throw Error("truncated vocabulary file");
@@ -1286,6 +1319,7 @@ Vocab& Vocab::operator=(Vocab&&) noexcept = default;
 
 Vocab Vocab::load(const std::filesystem::path& path) {
   Reader r(path);
+  r.read_header();
   Vocab res;
   res.using_capcode_ = r.read_byte();
   res.charset_ = r.read_byte();
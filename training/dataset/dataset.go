@@ -0,0 +1,402 @@
+// Package dataset reads the datasets given to -dataset by getalltokens and trainvocab.
+// A dataset is a file, a directory, a glob pattern, or a YAML or JSON manifest listing sources with weights, and files can be plain text or JSONL.
+package dataset
+
+import (
+	"io"
+	"os"
+	"log"
+	"math"
+	"bufio"
+	"bytes"
+	"errors"
+	"strings"
+	"strconv"
+	"path/filepath"
+	"encoding/json"
+	"compress/gzip"
+	"gopkg.in/yaml.v3"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	blockSize = 1024 * 1024 // bytes in each block taken when sampling a fraction of a dataset source
+)
+
+// Options for reading a dataset.
+type Options struct {
+	TextField	string	// the field containing the text in each record of a JSONL file
+	Separator	[]byte	// written after the text of each record of a JSONL file, nil for the document delimiter
+	Delimiter	[]byte	// the document delimiter as it is in the dataset, nil for none, which becomes NUL if there are JSONL files
+}
+
+// A source of a dataset in a manifest, the path can be a file, a directory or a glob pattern.
+type source struct {
+	Path	string	`yaml:"path"`
+	Weight	float64	`yaml:"weight"` // the proportion of the dataset, relative to the other weights
+	files	[]string
+	sizes	[]int64
+	size	int64
+	ratio	float64 // the number of times the source is read
+}
+
+type manifest struct {
+	Sources	[]source `yaml:"sources"`
+}
+
+// Lists the files for a dataset path, which can be a file, a directory (every file in it that's not hidden) or a glob pattern.
+func listFiles(path string) ([]string, error) {
+	var files []string
+	if strings.ContainsAny(path, `*?[`) {
+		matches, err := filepath.Glob(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			if info, err := os.Stat(match); err == nil && info.Mode().IsRegular() {
+				files = append(files, match)
+			}
+		}
+	} else {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			return []string{path}, nil
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.Type().IsRegular() && !strings.HasPrefix(entry.Name(), `.`) {
+				files = append(files, filepath.Join(path, entry.Name()))
+			}
+		}
+	}
+	if len(files) == 0 {
+		return nil, errors.New(`No files found for ` + path)
+	}
+	return files, nil
+}
+
+// Opens the dataset, which is a file, a directory, a glob pattern, or a YAML or JSON manifest listing sources with weights.
+// Files ending .jsonl or .ndjson (optionally followed by .gz, .zst or .zstd) are read as JSONL, and the text of each record is followed by the separator.
+// If there are JSONL files and no separator, then the separator is the document delimiter, which is set to NUL if there isn't one.
+// When there are weights each source is sampled or repeated so that it makes up that proportion of the dataset, which is the same total size as the sources.
+// The 2nd returned value is the size of the dataset in bytes, or 0 if it's not known.
+func (opt *Options) Open(spec string) (io.Reader, int64, error) {
+	var sources []source
+	switch strings.ToLower(filepath.Ext(spec)) {
+		case `.yaml`, `.yml`, `.json`:
+			data, err := os.ReadFile(spec)
+			if err != nil {
+				return nil, 0, err
+			}
+			var m manifest
+			if err = yaml.Unmarshal(data, &m); err != nil {
+				return nil, 0, errors.New(`Invalid dataset manifest: ` + err.Error())
+			}
+			if len(m.Sources) == 0 {
+				return nil, 0, errors.New(`The dataset manifest has no sources`)
+			}
+			sources = m.Sources
+			for i := range sources {
+				if !filepath.IsAbs(sources[i].Path) {
+					sources[i].Path = filepath.Join(filepath.Dir(spec), sources[i].Path)
+				}
+			}
+		default:
+			sources = []source{{Path:spec}}
+	}
+
+	var total, totalWeight float64
+	var weighted int
+	var hasJSONL bool
+	for i := range sources {
+		if sources[i].Weight < 0 {
+			return nil, 0, errors.New(`The weight of ` + sources[i].Path + ` is negative`)
+		}
+		if sources[i].Weight > 0 {
+			weighted++
+			totalWeight += sources[i].Weight
+		}
+	}
+	if weighted != 0 && weighted != len(sources) {
+		return nil, 0, errors.New(`Either all or none of the sources in the dataset manifest must have a weight`)
+	}
+	for i := range sources {
+		files, err := listFiles(sources[i].Path)
+		if err != nil {
+			return nil, 0, err
+		}
+		sources[i].files = files
+		sources[i].sizes = make([]int64, len(files))
+		for _, filename := range files {
+			if isJSONL(filename) {
+				hasJSONL = true
+			}
+		}
+	}
+	if hasJSONL && opt.Separator == nil { // the records are separated by the document delimiter
+		if opt.Delimiter == nil {
+			opt.Delimiter = []byte{0}
+		}
+		opt.Separator = opt.Delimiter
+	}
+	for i := range sources {
+		for k, filename := range sources[i].files {
+			if isJSONL(filename) {
+				if weighted > 0 { // the weights are by the size of the text and separators, which is only known by reading it
+					var err error
+					if sources[i].sizes[k], err = opt.jsonlTextSize(filename); err != nil {
+						return nil, 0, err
+					}
+				}
+			} else {
+				info, err := os.Stat(filename)
+				if err != nil {
+					return nil, 0, err
+				}
+				sources[i].sizes[k] = info.Size()
+			}
+			sources[i].size += sources[i].sizes[k]
+		}
+		total += float64(sources[i].size)
+	}
+
+	// The number of times each source is read, less than 1 to sample it or more than 1 to repeat it
+	var size int64
+	for i := range sources {
+		sources[i].ratio = 1
+		if weighted > 0 {
+			if sources[i].size == 0 {
+				return nil, 0, errors.New(`The source ` + sources[i].Path + ` is empty so it cannot be weighted`)
+			}
+			sources[i].ratio = ((total * sources[i].Weight) / totalWeight) / float64(sources[i].size)
+		}
+		size += int64(float64(sources[i].size) * sources[i].ratio)
+	}
+	if hasJSONL && weighted == 0 {
+		size = 0 // not known without reading the JSONL files
+	}
+
+	if len(sources) == 1 && len(sources[0].files) == 1 && sources[0].ratio == 1 && !hasJSONL {
+		fi, err := os.Open(sources[0].files[0])
+		if err != nil {
+			return nil, 0, err
+		}
+		return fi, size, nil
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(opt.write(writer, sources))
+	}()
+	return reader, size, nil
+}
+
+// Writes each source of the dataset the number of times given by its ratio, with the document delimiter (or a newline if there isn't one) between files.
+// For a fraction of a source, records of JSONL files are taken at regular intervals, and for other files blocks are taken at regular intervals and trimmed to whole lines where a block next to them was skipped.
+func (opt *Options) write(w io.Writer, sources []source) error {
+	var n, from, to int
+	var pos int64
+	var acc, pass float64
+	var skipped, skipNext bool
+	var chunk, tail []byte
+	end := opt.Delimiter // what's written after a file that does not already end with it
+	if len(end) == 0 {
+		end = []byte{'\n'}
+	}
+	buf := make([]byte, blockSize)
+	for _, src := range sources {
+		for remaining := src.ratio; remaining > 0.000001; remaining -= pass {
+			pass = math.Min(remaining, 1)
+			acc = 0
+			for k, filename := range src.files {
+				if isJSONL(filename) {
+					if err := opt.writeJSONL(w, filename, pass, &acc); err != nil {
+						return err
+					}
+					continue
+				}
+				fi, err := os.Open(filename)
+				if err != nil {
+					return err
+				}
+				skipped = false
+				tail = append(tail[:0], end...)
+				for pos = 0; pos < src.sizes[k]; pos += blockSize {
+					if acc + pass < 0.999999 { // skip this block
+						acc += pass
+						skipped = true
+						continue
+					}
+					acc += pass - 1
+					if n, err = fi.ReadAt(buf, pos); err != nil && err != io.EOF {
+						fi.Close()
+						return err
+					}
+					skipNext = acc + pass < 0.999999
+					from, to = 0, n
+					if skipped {
+						from = bytes.IndexByte(buf[:n], '\n') + 1
+					}
+					if skipNext && n == blockSize {
+						to = bytes.LastIndexByte(buf[:n], '\n') + 1
+					}
+					if from < to {
+						if _, err = w.Write(buf[from:to]); err != nil {
+							fi.Close()
+							return err
+						}
+						if chunk = buf[from:to]; len(chunk) > len(end) {
+							chunk = chunk[len(chunk) - len(end):]
+						}
+						tail = append(tail, chunk...)
+						tail = tail[len(tail) - len(end):]
+					}
+					skipped = skipNext
+				}
+				fi.Close()
+				if !bytes.Equal(tail, end) {
+					if _, err = w.Write(end); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Whether the file is JSONL, optionally compressed with gzip or zstd, by its extension.
+func isJSONL(filename string) bool {
+	filename = strings.ToLower(filename)
+	for _, ext := range []string{`.gz`, `.zst`, `.zstd`} {
+		filename = strings.TrimSuffix(filename, ext)
+	}
+	return strings.HasSuffix(filename, `.jsonl`) || strings.HasSuffix(filename, `.ndjson`)
+}
+
+// Calls fn with the text of each record of a JSONL file, which is the string in the text field.
+// Records without that field, or where it's not a string, are skipped.
+func (opt *Options) readJSONL(filename string, fn func([]byte) error) error {
+	fi, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+	var reader io.Reader = fi
+	switch strings.ToLower(filepath.Ext(filename)) {
+		case `.gz`:
+			gz, err := gzip.NewReader(fi)
+			if err != nil {
+				return errors.New(filename + `: ` + err.Error())
+			}
+			defer gz.Close()
+			reader = gz
+		case `.zst`, `.zstd`:
+			zr, err := zstd.NewReader(fi)
+			if err != nil {
+				return errors.New(filename + `: ` + err.Error())
+			}
+			defer zr.Close()
+			reader = zr
+	}
+	r := bufio.NewReaderSize(reader, 1024 * 1024)
+	var record map[string]json.RawMessage
+	var text string
+	var skipped int
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			record, text = nil, ``
+			if json.Unmarshal(line, &record) != nil || json.Unmarshal(record[opt.TextField], &text) != nil {
+				skipped++
+			} else if len(text) > 0 {
+				if err = fn([]byte(text)); err != nil {
+					return err
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.New(filename + `: ` + err.Error())
+		}
+	}
+	if skipped > 0 {
+		log.Println(`Skipped`, skipped, `records in`, filename, `without a string field`, opt.TextField)
+	}
+	return nil
+}
+
+// The number of bytes of text in a JSONL file including the separators.
+func (opt *Options) jsonlTextSize(filename string) (int64, error) {
+	var size int64
+	err := opt.readJSONL(filename, func(text []byte) error {
+		size += int64(len(text) + len(opt.Separator))
+		return nil
+	})
+	return size, err
+}
+
+// Writes the text of each record of a JSONL file followed by the separator.
+// If `pass` is less than 1 then that fraction of the records are written, taken at regular intervals.
+func (opt *Options) writeJSONL(w io.Writer, filename string, pass float64, acc *float64) error {
+	return opt.readJSONL(filename, func(text []byte) error {
+		if *acc + pass < 0.999999 { // skip this record
+			*acc += pass
+			return nil
+		}
+		*acc += pass - 1
+		if _, err := w.Write(text); err != nil {
+			return err
+		}
+		_, err := w.Write(opt.Separator)
+		return err
+	})
+}
+
+// Parses -doc-separator, returning nil for boundary, which means the records are separated by the document delimiter.
+func ParseSeparator(policy string) ([]byte, error) {
+	switch strings.ToLower(policy) {
+		case ``, `boundary`:
+			return nil, nil
+		case `newline`:
+			return []byte{'\n'}, nil
+		case `paragraph`:
+			return []byte{'\n', '\n'}, nil
+	}
+	return nil, errors.New(`doc-separator must be one of: boundary, newline, paragraph`)
+}
+
+// Parses -doc-delimiter, which is nul for a NUL byte, or a byte sequence that can contain escapes such as \n or \x00.
+func ParseDelimiter(s string) ([]byte, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	if strings.ToLower(s) == `nul` {
+		return []byte{0}, nil
+	}
+	unquoted, err := strconv.Unquote(`"` + strings.ReplaceAll(s, `"`, `\"`) + `"`)
+	if err != nil {
+		return nil, errors.New(`doc-delimiter is not valid: ` + s)
+	}
+	return []byte(unquoted), nil
+}
+
+// Normalizes the document delimiter with `normalize` the way it's normalized in the middle of the dataset.
+// Returns nil if nothing is left of it.
+func NormalizeDelimiter(b []byte, normalize func([]byte) []byte) []byte {
+	processed := normalize(append(append([]byte{'x'}, b...), 'x')) // guarded so that trim and leadingspace don't apply to it
+	if len(processed) > 0 && processed[0] == ' ' {
+		processed = processed[1:]
+	}
+	if len(processed) <= 2 {
+		return nil
+	}
+	return processed[1 : len(processed) - 1]
+}
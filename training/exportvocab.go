@@ -1,6 +1,7 @@
 package main
 
 import (
+	"io"
 	"os"
 	"fmt"
 	"flag"
@@ -17,8 +18,27 @@ import (
 	"github.com/alasdairforsythe/norm"
 )
 
+// Messages go to stdout, unless stdout is used for an output file
+var out io.Writer = os.Stdout
+
+// Opens the file for reading, or stdin if the filename is "-"
+func openInput(filename string) (*os.File, error) {
+	if filename == `-` {
+		return os.Stdin, nil
+	}
+	return os.Open(filename)
+}
+
+// Creates the file for writing, or stdout if the filename is "-"
+func createOutput(filename string) (*os.File, error) {
+	if filename == `-` {
+		return os.Stdout, nil
+	}
+	return os.Create(filename)
+}
+
 func loadTokensFromFile(filename string) (uint8, uint8, uint8, uint8, uint8, [][]byte, []float32, [][]byte, error) {
-	fi, err := os.Open(filename)
+	fi, err := openInput(filename)
 	if err != nil {
 		return 0, 0, 0, 0, 0, nil, nil, nil, err
 	}
@@ -60,7 +80,7 @@ func loadTokensFromFile(filename string) (uint8, uint8, uint8, uint8, uint8, [][
 }
 
 func saveTokensToFile(filename string, data [][]byte, scores []float32, usingCapcode uint8, charsetFlag uint8, normalize uint8, level uint8, reserve uint8, specialTokens [][]byte) error {
-	fi, err := os.Create(filename)
+	fi, err := createOutput(filename)
 	if err != nil {
 		return err
 	}
@@ -104,20 +124,20 @@ func die(msg string, showUsage bool) {
 func main() {
 
 	var resize int
-	var inputFilename, outputFilename, inputYaml, outputYaml, inputVocab, addSingleBytes, tokensFilename, addSpecialToken, setUnk, exists string
-	var excludeOtherBytes, orderByScore, resetTokenIds bool
+	var inputFilename, outputFilename, inputYaml, outputYaml, inputVocab, addSingleBytes, tokensFilename, addSpecialToken, setUnk, setByteFallback, exists, explain string
+	var excludeOtherBytes, orderByScore, resetTokenIds, validate bool
 	var charsetFlag, level, reserve, reserve2, usingCapcode, normalizeCode uint8
 	var tokens, specialTokens, encodedSpecialTokens [][]byte
 	var yaml []byte
 	var scores []float32
 	var err error
 
-	flag.StringVar(&inputVocab, "input-vocab", inputVocab, "an existing TokenMonster vocabulary file (optional)")
-	flag.StringVar(&inputFilename, "input", inputFilename, "tokens file or directory from trainvocab, if directory it will load the best performing tokens file in the directory (optional)")
-	flag.StringVar(&outputFilename, "output", outputFilename, "filename of the vocabulary to output (optional)")
-	flag.StringVar(&tokensFilename, "output-tokens", tokensFilename, "converts a vocabulary back to a tokens file that can be used with trainvocab (optional)")
-	flag.StringVar(&inputYaml, "input-yaml", inputYaml, "filename of a YAML file containing modifications or a new vocabulary (optional)")
-	flag.StringVar(&outputYaml, "output-yaml", inputYaml, "filename to export the vocabulary in YAML format (optional)")
+	flag.StringVar(&inputVocab, "input-vocab", inputVocab, "an existing TokenMonster vocabulary file, or - for stdin (optional)")
+	flag.StringVar(&inputFilename, "input", inputFilename, "tokens file or directory from trainvocab, if directory it will load the best performing tokens file in the directory, or - for stdin (optional)")
+	flag.StringVar(&outputFilename, "output", outputFilename, "filename of the vocabulary to output, or - for stdout (optional)")
+	flag.StringVar(&tokensFilename, "output-tokens", tokensFilename, "converts a vocabulary back to a tokens file that can be used with trainvocab, or - for stdout (optional)")
+	flag.StringVar(&inputYaml, "input-yaml", inputYaml, "filename of a YAML file containing modifications or a new vocabulary, or - for stdin (optional)")
+	flag.StringVar(&outputYaml, "output-yaml", inputYaml, "filename to export the vocabulary in YAML format, or - for stdout (optional)")
 	flag.StringVar(&addSingleBytes, "add-single-bytes", addSingleBytes, "enter \"256\", \"128\", \"ascii\", \"extended\" or \"utf8\" to add tokens for those individual bytes (optional)")
 	flag.BoolVar(&excludeOtherBytes, "delete-single-bytes", excludeOtherBytes, "deletes all the single byte tokens except those specified from add-single-bytes (optional)")
 	flag.IntVar(&resize, "resize", resize, "resizes the vocabulary to this many tokens by deleting the worst scoring tokens (optional)")
@@ -126,6 +146,9 @@ func main() {
 	flag.StringVar(&addSpecialToken, "add-special-token", addSpecialToken, "a single special token to add to the vocabulary (optional)")
 	flag.StringVar(&exists, "exists", exists, "check if a token exists in the vocabulary (optional)")
 	flag.StringVar(&setUnk, "unk", setUnk, "set to true or false to enable or disable the UNK token (optional)")
+	flag.StringVar(&setByteFallback, "byte-fallback", setByteFallback, "set to true or false to enable or disable byte fallback, which keeps a token for every byte so that nothing is lost (optional)")
+	flag.StringVar(&explain, "explain", explain, "tokenizes this text and prints the branches considered at each step and why each was chosen (optional)")
+	flag.BoolVar(&validate, "validate", validate, "checks the vocabulary is consistent and exits with an error if not, before any output (optional) (default false)")
 	flag.Parse()
 	if len(inputFilename) == 0 && len(inputYaml) == 0 && len(inputVocab) == 0 {
 		flag.Usage()
@@ -134,9 +157,36 @@ func main() {
 	if len(inputFilename) > 0 && len(inputVocab) > 0 {
 		die("You cannot input both a vocabulary and a tokens file at the same time.", true)
 	}
+	var numStdin, numStdout int
+	for _, filename := range []string{inputFilename, inputVocab, inputYaml} {
+		if filename == `-` {
+			numStdin++
+		}
+	}
+	for _, filename := range []string{outputFilename, tokensFilename, outputYaml} {
+		if filename == `-` {
+			numStdout++
+		}
+	}
+	if numStdin > 1 {
+		die("Only one input can be read from stdin.", true)
+	}
+	if numStdout > 1 {
+		die("Only one output can be written to stdout.", true)
+	}
+	if numStdout > 0 {
+		out = os.Stderr
+	}
+	if numStdin > 0 && (len(addSpecialToken) > 1 || (excludeOtherBytes && len(addSingleBytes) == 0)) {
+		die("Confirmation is required from stdin, so stdin cannot be used as an input.", false)
+	}
 
 	if len(inputYaml) > 0 {
-		yaml, err = ioutil.ReadFile(inputYaml)
+		if inputYaml == `-` {
+			yaml, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			yaml, err = ioutil.ReadFile(inputYaml)
+		}
 		if err != nil {
 			die("Error reading input-yaml file: " + err.Error(), false)
 		}
@@ -146,6 +196,13 @@ func main() {
 	if len(setUnk) > 0 {
 		setUnk = string(setUnk[0])
 	}
+	setByteFallback = strings.TrimSpace(strings.ToLower(setByteFallback))
+	if len(setByteFallback) > 0 {
+		setByteFallback = string(setByteFallback[0])
+	}
+	if setByteFallback == "t" || setByteFallback == "y" {
+		reserve |= 1 << 6 // byte fallback is enabled when the vocabulary is generated, so that it's included in resize
+	}
 	if len(addSingleBytes) > 0 {
 		switch strings.ToLower(addSingleBytes) {
 			case `256`:
@@ -168,18 +225,18 @@ func main() {
 		if reserve == 0 {
 			reader := bufio.NewReader(os.Stdin)
 			for {
-				fmt.Printf("Your settings will delete all single byte tokens. Are you sure? (y/n)\n")
+				fmt.Fprintf(out, "Your settings will delete all single byte tokens. Are you sure? (y/n)\n")
 				text, _ := reader.ReadString('\n')
 				text = strings.Replace(text, "\n", "", -1)
 		
 				if strings.ToLower(text) == "y" {
-					fmt.Println("Confirmed")
+					fmt.Fprintln(out, "Confirmed")
 					break
 				} else if strings.ToLower(text) == "n" {
-					fmt.Println("Closing")
+					fmt.Fprintln(out, "Closing")
 					os.Exit(0)
 				} else {
-					fmt.Println("Please respond with 'y' or 'n'")
+					fmt.Fprintln(out, "Please respond with 'y' or 'n'")
 				}
 			}
 		}
@@ -188,31 +245,35 @@ func main() {
 	if len(addSpecialToken) > 1 {
 		reader := bufio.NewReader(os.Stdin)
 		for {
-			fmt.Printf("You've entered '%s' as your special token. Is this correct? (y/n)\n", addSpecialToken)
+			fmt.Fprintf(out, "You've entered '%s' as your special token. Is this correct? (y/n)\n", addSpecialToken)
 			text, _ := reader.ReadString('\n')
 			text = strings.Replace(text, "\n", "", -1)
 	
 			if strings.ToLower(text) == "y" {
 				specialTokens = append(specialTokens, []byte(addSpecialToken))
-				fmt.Println("Confirmed")
+				fmt.Fprintln(out, "Confirmed")
 				break
 			} else if strings.ToLower(text) == "n" {
-				fmt.Println("Closing")
+				fmt.Fprintln(out, "Closing")
 				os.Exit(0)
 			} else {
-				fmt.Println("Please respond with 'y' or 'n'")
+				fmt.Fprintln(out, "Please respond with 'y' or 'n'")
 			}
 		}
 	}
 
 	// Load tokens file
 	if len(inputFilename) != 0 {
-		fileInfo, err := os.Stat(inputFilename)
-		if err != nil {
-			die(err.Error(), false)
+		var isDir bool
+		if inputFilename != `-` {
+			fileInfo, err := os.Stat(inputFilename)
+			if err != nil {
+				die(err.Error(), false)
+			}
+			isDir = fileInfo.IsDir()
 		}
 
-		if fileInfo.IsDir() {
+		if isDir {
 			files, err := ioutil.ReadDir(inputFilename)
 			if err != nil {
 				die(err.Error(), false)
@@ -242,7 +303,7 @@ func main() {
 			inputFilename = filepath.Join(inputFilename, firstFile)
 		}
 
-		fmt.Println(`Loading`, inputFilename)
+		fmt.Fprintln(out, `Loading`, inputFilename)
 		usingCapcode, charsetFlag, normalizeCode, level, reserve2, tokens, scores, encodedSpecialTokens, err = loadTokensFromFile(inputFilename)
 		if err != nil {
 			die(err.Error(), false)
@@ -256,8 +317,12 @@ func main() {
 	vocab := new(tokenmonster.Vocab)
 	var vocabLoaded bool
 	if len(inputVocab) != 0 {
-		fmt.Println(`Loading`, inputVocab)
-		vocab, err = tokenmonster.Load(inputVocab)
+		fmt.Fprintln(out, `Loading`, inputVocab)
+		if inputVocab == `-` {
+			vocab, err = tokenmonster.LoadFrom(os.Stdin)
+		} else {
+			vocab, err = tokenmonster.Load(inputVocab)
+		}
 		if err != nil {
 			die(err.Error(), false)
 		}
@@ -283,6 +348,9 @@ func main() {
 	if setUnk == "f" || setUnk == "n" {
 		vocab.DisableUnkToken()
 	}
+	if setByteFallback == "f" || setByteFallback == "n" {
+		vocab.DisableByteFallback()
+	}
 	usingCapcode = vocab.Capcode()
 	charsetFlag = vocab.Charset()
 	level = vocab.Mode()
@@ -297,68 +365,91 @@ func main() {
 	
 	switch usingCapcode {
 		case 0:
-			fmt.Println(`Capcode:               0 (disabled)`)
+			fmt.Fprintln(out, `Capcode:               0 (disabled)`)
 		case 1:
-			fmt.Println(`Capcode:               1 (deleteToken)`)
+			fmt.Fprintln(out, `Capcode:               1 (deleteToken)`)
 		case 2:
-			fmt.Println(`Capcode:               2 (enabled)`)
+			fmt.Fprintln(out, `Capcode:               2 (enabled)`)
 		default:
 			die(`capcode value is invalid`, false)
 	}
 	switch charsetFlag {
 		case 0:
-			fmt.Println(`Charset:               None`)
+			fmt.Fprintln(out, `Charset:               None`)
 		case 1:
-			fmt.Println(`Charset:               UTF-8`)
+			fmt.Fprintln(out, `Charset:               UTF-8`)
 		case 2:
-			fmt.Println(`Charset:               UTF-16`)
+			fmt.Fprintln(out, `Charset:               UTF-16`)
 		default:
 			die(`charset value is invalid`, false)
 	}
-	fmt.Println(`Normalization:         ` + vocab.Normalization())
+	fmt.Fprintln(out, `Normalization:         ` + vocab.Normalization())
 	switch level {
 		case 0:
-			fmt.Println(`Optimization mode:     0 (unfiltered)`)
+			fmt.Fprintln(out, `Optimization mode:     0 (unfiltered)`)
 		case 1:
-			fmt.Println(`Optimization mode:     1 (clean)`)
+			fmt.Fprintln(out, `Optimization mode:     1 (clean)`)
 		case 2:
-			fmt.Println(`Optimization mode:     2 (balanced)`)
+			fmt.Fprintln(out, `Optimization mode:     2 (balanced)`)
 		case 3:
-			fmt.Println(`Optimization mode:     3 (consistent)`)
+			fmt.Fprintln(out, `Optimization mode:     3 (consistent)`)
 		case 4:
-			fmt.Println(`Optimization mode:     4 (strict)`)
+			fmt.Fprintln(out, `Optimization mode:     4 (strict)`)
 		default:
-			fmt.Println(`Optimization mode:     N/A`)
+			fmt.Fprintln(out, `Optimization mode:     N/A`)
 	}	
-	fmt.Println(`Maximum token length: `, vocab.MaxTokenLength())
-	fmt.Println(`Regular tokens:       `, numRegular)
-	fmt.Println(`Single byte tokens:   `, numSingleBytes)
-	fmt.Println(`Special tokens:       `, numSpecialTokens)
+	fmt.Fprintln(out, `Maximum token length: `, vocab.MaxTokenLength())
+	fmt.Fprintln(out, `Regular tokens:       `, numRegular)
+	fmt.Fprintln(out, `Single byte tokens:   `, numSingleBytes)
+	fmt.Fprintln(out, `Special tokens:       `, numSpecialTokens)
 	if numSpecialTokens > 0 {
 		for _, v := range specialTokensList {
-			fmt.Println(`                       [ID ` + conv.String(int(v.Id)) + `]`, string(v.TokenDecoded))
+			fmt.Fprintln(out, `                       [ID ` + conv.String(int(v.Id)) + `]`, string(v.TokenDecoded))
 		}
 	}
 	if vocab.HasUnk() {
-		fmt.Println(`UNK token:             Yes [ID ` + conv.String(int(vocab.Unk())) + `]`)
+		fmt.Fprintln(out, `UNK token:             Yes [ID ` + conv.String(int(vocab.Unk())) + `]`)
 		total++
 	} else {
 		if (numSingleBytes < 256 && usingCapcode!=2) || numSingleBytes < 233 {
-			fmt.Println(`UNK token:             No (can be added)`)
+			fmt.Fprintln(out, `UNK token:             No (can be added)`)
 		} else {
-			fmt.Println(`UNK token:             No (all bytes have tokens)`)
+			fmt.Fprintln(out, `UNK token:             No (all bytes have tokens)`)
 		}
 	}
-	fmt.Println(`Deleted tokens:       `, vocab.NumDeletedTokens())
-	fmt.Println(`Total tokens:         `, vocab.Len())
-	fmt.Println()
+	if vocab.ByteFallback() {
+		fmt.Fprintln(out, `Byte fallback:         Yes`)
+	} else {
+		fmt.Fprintln(out, `Byte fallback:         No`)
+	}
+	if vocab.IsLossless() {
+		fmt.Fprintln(out, `Lossless:              Yes`)
+	} else {
+		fmt.Fprintln(out, `Lossless:              No`)
+	}
+	fmt.Fprintln(out, `Deleted tokens:       `, vocab.NumDeletedTokens())
+	fmt.Fprintln(out, `Total tokens:         `, vocab.Len())
+	fmt.Fprintln(out)
+
+	if validate {
+		if err = vocab.Validate(); err != nil {
+			die("Vocabulary is invalid: " + err.Error(), false)
+		}
+		fmt.Fprintln(out, `Vocabulary is valid`)
+		fmt.Fprintln(out)
+	}
 
 	// Create the vocabulary file
 	if len(outputFilename) > 0 {
-		if err = vocab.Save(outputFilename); err != nil {
+		if outputFilename == `-` {
+			_, err = vocab.WriteTo(os.Stdout)
+		} else {
+			err = vocab.Save(outputFilename)
+		}
+		if err != nil {
 			die(err.Error(), false)
 		}
-		fmt.Println(`Exported:`, outputFilename)
+		fmt.Fprintln(out, `Exported:`, outputFilename)
 	}
 
 	if len(tokensFilename) > 0 {
@@ -381,38 +472,87 @@ func main() {
 		if err != nil {
 			die(err.Error(), false)
 		}
-		fmt.Println(`Exported:`, tokensFilename)
+		fmt.Fprintln(out, `Exported:`, tokensFilename)
 	}
 
 	if len(outputYaml) > 0 {
-		fi, err := os.Create(outputYaml)
+		fi, err := createOutput(outputYaml)
 		if err != nil {
 			die(`Unable to create file: ` + outputYaml, false)
 		}
 		defer fi.Close()
 		vocab.ExportYAML(fi, orderByScore)
-		fmt.Println(`Exported:`, outputYaml)
+		fmt.Fprintln(out, `Exported:`, outputYaml)
 	}
 
 	if len(exists) > 0 {
-		fmt.Println(`Looking for token: '` + exists + `'`)
+		fmt.Fprintln(out, `Looking for token: '` + exists + `'`)
 		tok := []byte(exists)
 		tok2, _ := vocab.Normalize(tok)
 		id, found := vocab.TokenToId(tok)
 		if found {
-			fmt.Println("\tID:", id)
-			fmt.Println("\t\tEncoded: '" + string(tok) + `'`)
-			fmt.Println("\t\tDecoded: '" + string(vocab.Denormalize(tok)) + `'`)
+			fmt.Fprintln(out, "\tID:", id)
+			fmt.Fprintln(out, "\t\tEncoded: '" + string(tok) + `'`)
+			fmt.Fprintln(out, "\t\tDecoded: '" + string(vocab.Denormalize(tok)) + `'`)
 		}
 		id2, found2 := vocab.TokenToId(tok2)
 		if found2 && id2 != id {
-			fmt.Println("\tID:", id2)
-			fmt.Println("\t\tEncoded: '" + string(tok2) + `'`)
-			fmt.Println("\t\tDecoded: '" + string(vocab.Denormalize(tok2)) + `'`)
+			fmt.Fprintln(out, "\tID:", id2)
+			fmt.Fprintln(out, "\t\tEncoded: '" + string(tok2) + `'`)
+			fmt.Fprintln(out, "\t\tDecoded: '" + string(vocab.Denormalize(tok2)) + `'`)
 		}
 		if !found && !found2 {
-			fmt.Println("\tNo tokens found")
+			fmt.Fprintln(out, "\tNo tokens found")
+		}
+		fmt.Fprintln(out)
+	}
+
+	if len(explain) > 0 {
+		steps, normalized, err := vocab.TokenizeTrace([]byte(explain))
+		if err != nil {
+			die(err.Error(), false)
 		}
-		fmt.Println()
+		fmt.Fprintln(out, `Explaining: '` + explain + `'`)
+		fmt.Fprintf(out, "Normalized: %q\n", normalized)
+		for _, step := range steps {
+			if step.Missing {
+				fmt.Fprintf(out, "[%d] %q has no token\n", step.Position, normalized[step.Position:step.Position + 1])
+				continue
+			}
+			fmt.Fprintf(out, "[%d] Longest %s", step.Position, explainToken(vocab, step.Longest))
+			if step.AfterDelete {
+				fmt.Fprint(out, " (after delete token)")
+			}
+			if step.Chosen == -1 {
+				fmt.Fprintln(out, " used without comparing branches:", step.Reason)
+				continue
+			}
+			fmt.Fprintln(out)
+			for k, c := range step.Candidates {
+				marker := ` `
+				if k == step.Chosen {
+					marker = `*`
+				}
+				var toks []string
+				for _, id := range c.Tokens {
+					toks = append(toks, explainToken(vocab, id))
+				}
+				p := c.Parts
+				fmt.Fprintf(out, "\t%s %-21s %s then %s\n", marker, c.Branch, strings.Join(toks, ` `), explainToken(vocab, c.Next))
+				fmt.Fprintf(out, "\t\tscore %d = length %d + types %d + word beginnings %d + begins space %d + space after %d + whole words %d", c.Score, p.Length, p.Types, p.WordBeginnings, p.BeginsSpace, p.SpaceAfter, p.WholeWords)
+				for _, d := range []struct{ name string; value int }{{`split word`, p.SplitWord}, {`split capcode`, p.SplitCapcode}, {`ends in word`, p.EndsInWord}, {`extra token`, p.ExtraToken}, {`shorter`, p.Shorter}, {`same length`, p.SameLength}} {
+					if d.value != 0 {
+						fmt.Fprintf(out, " - %s %d", d.name, -d.value)
+					}
+				}
+				fmt.Fprintln(out)
+			}
+		}
+		fmt.Fprintln(out)
 	}
 }
+
+// Formats a token for -explain as its encoded form and ID
+func explainToken(vocab *tokenmonster.Vocab, id uint32) string {
+	return fmt.Sprintf("%q [ID %d]", vocab.IdToToken(id), id)
+}
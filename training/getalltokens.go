@@ -5,8 +5,10 @@ package main
 */
 
 import (
+	"io"
 	"os"
 	"log"
+	"bytes"
 	"fmt"
 	"flag"
 	"sync"
@@ -15,7 +17,6 @@ import (
 	"runtime"
 	"reflect"
 	"unicode"
-	"io/ioutil"
 	"unicode/utf8"
 	"unicode/utf16"
 	"encoding/binary"
@@ -24,6 +25,7 @@ import (
 	"github.com/alasdairforsythe/norm"
 	"github.com/alasdairforsythe/pansearch"
 	"github.com/alasdairforsythe/capcode/go"
+	"github.com/alasdairforsythe/tokenmonster/training/dataset"
 )
 
 const (
@@ -34,6 +36,10 @@ const (
 	runeError 		 = '\uFFFD'
 	apostrophe	   	 = '\''
 	apostrophe2      = '’'
+	normTrim		 = 32 // norm.Normalizer flags
+	normLeadingSpace = 64
+	datasetReadSize  = 1024 * 1024 * 4 // bytes read from the dataset at a time
+	datasetMaxSegment = 1024 * 1024 * 16 // if there is no newline within this many bytes, a space is used to segment instead
 )
 
 var delimiterPairs = map[rune]rune{
@@ -88,10 +94,26 @@ var (
 	numWorkers int = 8
 	onlyLatin bool
 	onlyValid bool
+	textField string = `text`
+	docSeparatorFlag string
+	docSeparator []byte // written after each document of a JSONL dataset
+	docDelimiterFlag string
+	docDelimiterRaw []byte // the document delimiter as it is in the dataset
+	docDelimiter []byte // the normalized document delimiter, tokens are never found across this
 	normFlag string
 	wordsPerToken int
 )
 
+type datasetReader struct {
+	reader io.Reader
+	raw []byte // data read that has not yet been normalized
+	normalized []byte // normalized data that has not yet been returned in a chunk
+	read int // bytes read
+	total int // normalized bytes returned
+	started bool // the beginning of the dataset has been normalized
+	eof bool
+}
+
 type workStruct struct {
 	chunkId int
 	data [][]byte
@@ -183,6 +205,138 @@ func normalize(data []byte) []byte {
 	return processed
 }
 
+// Normalizes a segment of the dataset, where `first` and `last` are whether it's at the beginning or end of the dataset.
+// The trim and leadingspace normalizations apply only to the beginning and end of the whole dataset, so the segment is guarded to avoid them being applied in the middle.
+func normalizeSegment(b []byte, first bool, last bool) []byte {
+	if normalizer.Flag & (normTrim | normLeadingSpace) == 0 || (first && last) {
+		return normalize(b)
+	}
+	guarded := make([]byte, 0, len(b) + 2)
+	if !first {
+		guarded = append(guarded, 'x')
+	}
+	guarded = append(guarded, b...)
+	if !last {
+		guarded = append(guarded, 'x')
+	}
+	processed, err := normalizer.Normalize(guarded)
+	if err != nil {
+		panic(err)
+	}
+	if !first {
+		if len(processed) > 0 && processed[0] == ' ' { // leading space was added before the guard
+			processed = processed[1:]
+		}
+		processed = processed[1:]
+	}
+	if !last {
+		processed = processed[:len(processed) - 1]
+	}
+	return applyCapcode(processed)
+}
+
+// Moves `pos` back to the beginning of the character it's in, so that the data can be split there without splitting a character.
+func glyphBoundary(b []byte, pos int) int {
+	if charsetFlag == 1 {
+		i := pos
+		for i > 0 && i < len(b) && b[i] & 0xC0 == 0x80 && pos - i < 3 {
+			i--
+		}
+		if i > 0 {
+			return i
+		}
+	}
+	return pos
+}
+
+// Returns the last point in the raw data at which the text can be normalized separately from what follows, or 0 if there isn't one yet.
+// That's a newline followed by a newline or ASCII character, or the end of a document delimiter, or if there is no newline for a long way, a space after an ASCII character, or failing that any character.
+func datasetSegment(b []byte) int {
+	var after int
+	if len(docDelimiterRaw) > 0 {
+		if n := bytes.LastIndex(b, docDelimiterRaw); n >= 0 {
+			after = n + len(docDelimiterRaw)
+		}
+	}
+	for i := len(b) - 1; i > after; i-- {
+		if b[i-1] == '\n' && (b[i] == '\n' || (b[i] > 32 && b[i] < 128)) {
+			return i
+		}
+	}
+	if after > 0 {
+		return after
+	}
+	if len(b) > datasetMaxSegment {
+		for i := len(b) - 1; i >= 1; i-- {
+			if b[i] == ' ' && b[i-1] > 32 && b[i-1] < 128 {
+				return i
+			}
+		}
+		return glyphBoundary(b, len(b) - 1)
+	}
+	return 0
+}
+
+func (d *datasetReader) fill() error {
+	if cap(d.raw) - len(d.raw) < datasetReadSize {
+		raw := make([]byte, len(d.raw), len(d.raw) + (datasetReadSize * 2))
+		copy(raw, d.raw)
+		d.raw = raw
+	}
+	n, err := d.reader.Read(d.raw[len(d.raw) : len(d.raw) + datasetReadSize])
+	d.raw = d.raw[0 : len(d.raw) + n]
+	d.read += n
+	if err == io.EOF {
+		d.eof = true
+		return nil
+	}
+	return err
+}
+
+// Reads and normalizes the next `chunkSize` bytes of the dataset, split into micro-chunks of `microChunkSize`, without splitting characters.
+// The 2nd returned value is whether this is the last chunk.
+func (d *datasetReader) nextChunk(chunkSize int, microChunkSize int) ([][]byte, bool, error) {
+	var cut, to int
+	for len(d.normalized) < chunkSize && !(d.eof && len(d.raw) == 0) {
+		if !d.eof {
+			if err := d.fill(); err != nil {
+				return nil, false, err
+			}
+		}
+		cut = len(d.raw)
+		if !d.eof {
+			cut = datasetSegment(d.raw)
+		}
+		if cut > 0 {
+			d.normalized = append(d.normalized, normalizeSegment(d.raw[:cut], !d.started, d.eof && cut == len(d.raw))...)
+			d.started = true
+			d.raw = d.raw[:copy(d.raw, d.raw[cut:])]
+		}
+	}
+
+	// Copy out the chunk so that the rest can be kept for the next one
+	to = len(d.normalized)
+	if to > chunkSize {
+		to = glyphBoundary(d.normalized, chunkSize)
+	}
+	data := make([]byte, to)
+	copy(data, d.normalized)
+	d.normalized = d.normalized[:copy(d.normalized, d.normalized[to:])]
+	d.total += to
+
+	// Split the data into micro-chunks
+	chunk := make([][]byte, 0, (len(data) / microChunkSize) + 1)
+	for len(data) > 0 {
+		to = len(data)
+		if to > microChunkSize {
+			to = glyphBoundary(data, microChunkSize)
+		}
+		chunk = append(chunk, data[:to])
+		data = data[to:]
+	}
+	return chunk, d.eof && len(d.raw) == 0 && len(d.normalized) == 0, nil
+}
+
 func saveTokensToFile(filename string, obj *pansearch.Counter) error {
 	fi, err := os.Create(filename)
 	if err != nil {
@@ -1104,11 +1258,21 @@ func filterStrict(tok []byte) ([]byte, bool) {
 	return trimmed, true
 }
 
-func processChunkUnfiltered(asset workStruct, numChunks int, trim bool) *pansearch.Counter {
-	log.Println(`Finding tokens in chunk`, asset.chunkId, `of`, numChunks)
+// Returns the position of the next document delimiter in data at or after `i`, or len(data) if there isn't one.
+func nextDelimiter(data []byte, i int) int {
+	if len(docDelimiter) > 0 {
+		if n := bytes.Index(data[i:], docDelimiter); n >= 0 {
+			return i + n
+		}
+	}
+	return len(data)
+}
+
+func processChunkUnfiltered(asset workStruct, trim bool) *pansearch.Counter {
+	log.Println(`Finding tokens in chunk`, asset.chunkId)
 	tokens := asset.tokens
 	lastMicroChunk := len(asset.data) - 1
-	var i, l, length int
+	var i, l, length, next int
 	var max int = maxTokenLength
 
 	// Process microchunks
@@ -1117,9 +1281,22 @@ func processChunkUnfiltered(asset workStruct, numChunks int, trim bool) *pansear
 		// Move forward one character at a time capturing all possible combinations of characters from 2 to maxTokenLength
 		
 		_ = data[0 : l + max] // infer to the optimizer that we don't access beyond this
+		next = nextDelimiter(data, 0)
 		for i = 0; i < l; i++ {
+			if i >= next {
+				if i >= next + len(docDelimiter) {
+					next = nextDelimiter(data, i)
+				}
+				if i >= next { // inside the document delimiter
+					continue
+				}
+			}
 			charTable[data[i]]++ // single characters recorded separately
-			for length = max; length >= 2; length-- {
+			length = max
+			if next - i < length {
+				length = next - i
+			}
+			for ; length >= 2; length-- {
 				tokens.Add(data[i:i+length], 1)
 			}
 		}
@@ -1146,7 +1323,7 @@ func processChunkUnfiltered(asset workStruct, numChunks int, trim bool) *pansear
 
 	// Trim the chunk
 	if trim {
-		log.Println(`Trimming chunk`, asset.chunkId, `of`, numChunks)
+		log.Println(`Trimming chunk`, asset.chunkId)
 		if multithreaded {
 			tokens.Build_With_Min_Multithreaded(minOccurPerChunk)
 		} else {
@@ -1156,7 +1333,7 @@ func processChunkUnfiltered(asset workStruct, numChunks int, trim bool) *pansear
 		runtime.GC()
 	}
 
-	//log.Println(`Completed chunk`, asset.chunkId, `of`, numChunks)
+	//log.Println(`Completed chunk`, asset.chunkId)
 	return tokens
 }
 
@@ -1233,11 +1410,11 @@ func workerStrict(max int, jobs <-chan [][]byte, ret chan<- [][]byte) {
 
 }
 
-func processChunkMulti(asset workStruct, numChunks int, trim bool, level uint8) *pansearch.Counter {
-	log.Println(`Finding tokens in chunk`, asset.chunkId, `of`, numChunks)
+func processChunkMulti(asset workStruct, trim bool, level uint8) *pansearch.Counter {
+	log.Println(`Finding tokens in chunk`, asset.chunkId)
 	tokens := asset.tokens
 	lastMicroChunk := len(asset.data) - 1
-	var i, l, length, on int
+	var i, l, length, on, next int
 	var maxTokenLengthEffective int = maxTokenLength + 1
 	lenJob := (maxTokenLengthEffective - 3) + 1
 	lenJob1000 := lenJob * 2500 // 100,000
@@ -1295,9 +1472,22 @@ func processChunkMulti(asset workStruct, numChunks int, trim bool, level uint8)
 
 		on = 0
 		job := make([][]byte, lenJob1000)
+		next = nextDelimiter(data, 0)
 		for i = 0; i < l; i++ {
+			if i >= next {
+				if i >= next + len(docDelimiter) {
+					next = nextDelimiter(data, i)
+				}
+				if i >= next { // inside the document delimiter
+					continue
+				}
+			}
 			charTable[data[i]]++ // single characters recorded separately
-			for length = maxTokenLengthEffective; length >= 3; length-- {
+			length = maxTokenLengthEffective
+			if next + 1 - i < length { // the first byte of the delimiter can be the character after the token
+				length = next + 1 - i
+			}
+			for ; length >= 3; length-- {
 				job[on] = data[i:i+length]
 				on++
 			}
@@ -1335,7 +1525,7 @@ func processChunkMulti(asset workStruct, numChunks int, trim bool, level uint8)
 
 	// Trim the chunk
 	if trim {
-		log.Println(`Trimming chunk`, asset.chunkId, `of`, numChunks)
+		log.Println(`Trimming chunk`, asset.chunkId)
 		if multithreaded {
 			tokens.Build_With_Min_Multithreaded(minOccurPerChunk)
 		} else {
@@ -1345,15 +1535,15 @@ func processChunkMulti(asset workStruct, numChunks int, trim bool, level uint8)
 		runtime.GC()
 	}
 
-	//log.Println(`Completed chunk`, asset.chunkId, `of`, numChunks)
+	//log.Println(`Completed chunk`, asset.chunkId)
 	return tokens
 }
 
-func processChunkClean(asset workStruct, numChunks int, trim bool) *pansearch.Counter {
-	log.Println(`Finding tokens in chunk`, asset.chunkId, `of`, numChunks)
+func processChunkClean(asset workStruct, trim bool) *pansearch.Counter {
+	log.Println(`Finding tokens in chunk`, asset.chunkId)
 	tokens := asset.tokens
 	lastMicroChunk := len(asset.data) - 1
-	var i, l, length int
+	var i, l, length, next int
 	var maxTokenLengthEffective int = maxTokenLength + 1
 	var max = maxTokenLength
 	var okay bool
@@ -1365,9 +1555,22 @@ func processChunkClean(asset workStruct, numChunks int, trim bool) *pansearch.Co
 		// Move forward one character at a time capturing all possible combinations of characters from 2 to maxTokenLength
 		
 		_ = data[0 : l + maxTokenLengthEffective] // infer to the optimizer that we don't access beyond this
+		next = nextDelimiter(data, 0)
 		for i = 0; i < l; i++ {
+			if i >= next {
+				if i >= next + len(docDelimiter) {
+					next = nextDelimiter(data, i)
+				}
+				if i >= next { // inside the document delimiter
+					continue
+				}
+			}
 			charTable[data[i]]++ // single characters recorded separately
-			for length = maxTokenLengthEffective; length >= 3; length-- {
+			length = maxTokenLengthEffective
+			if next + 1 - i < length { // the first byte of the delimiter can be the character after the token
+				length = next + 1 - i
+			}
+			for ; length >= 3; length-- {
 				if clean, okay = filterClean(data[i:i+length]); okay {
 					if len(clean) >= 2 && len(clean) <= max {
 						tokens.Add(clean, 1)
@@ -1398,7 +1601,7 @@ func processChunkClean(asset workStruct, numChunks int, trim bool) *pansearch.Co
 
 	// Trim the chunk
 	if trim {
-		log.Println(`Trimming chunk`, asset.chunkId, `of`, numChunks)
+		log.Println(`Trimming chunk`, asset.chunkId)
 		if multithreaded {
 			tokens.Build_With_Min_Multithreaded(minOccurPerChunk)
 		} else {
@@ -1408,15 +1611,15 @@ func processChunkClean(asset workStruct, numChunks int, trim bool) *pansearch.Co
 		runtime.GC()
 	}
 
-	//log.Println(`Completed chunk`, asset.chunkId, `of`, numChunks)
+	//log.Println(`Completed chunk`, asset.chunkId)
 	return tokens
 }
 
-func processChunkBalanced(asset workStruct, numChunks int, trim bool) *pansearch.Counter {
-	log.Println(`Finding tokens in chunk`, asset.chunkId, `of`, numChunks)
+func processChunkBalanced(asset workStruct, trim bool) *pansearch.Counter {
+	log.Println(`Finding tokens in chunk`, asset.chunkId)
 	tokens := asset.tokens
 	lastMicroChunk := len(asset.data) - 1
-	var i, l, length int
+	var i, l, length, next int
 	var maxTokenLengthEffective int = maxTokenLength + 1
 	var max = maxTokenLength
 	var okay bool
@@ -1428,9 +1631,22 @@ func processChunkBalanced(asset workStruct, numChunks int, trim bool) *pansearch
 		// Move forward one character at a time capturing all possible combinations of characters from 2 to maxTokenLength
 		
 		_ = data[0 : l + maxTokenLengthEffective] // infer to the optimizer that we don't access beyond this
+		next = nextDelimiter(data, 0)
 		for i = 0; i < l; i++ {
+			if i >= next {
+				if i >= next + len(docDelimiter) {
+					next = nextDelimiter(data, i)
+				}
+				if i >= next { // inside the document delimiter
+					continue
+				}
+			}
 			charTable[data[i]]++ // single characters recorded separately
-			for length = maxTokenLengthEffective; length >= 3; length-- {
+			length = maxTokenLengthEffective
+			if next + 1 - i < length { // the first byte of the delimiter can be the character after the token
+				length = next + 1 - i
+			}
+			for ; length >= 3; length-- {
 				if clean, okay = filterBalanced(data[i:i+length]); okay {
 					if len(clean) >= 2 && len(clean) <= max {
 						tokens.Add(clean, 1)
@@ -1461,7 +1677,7 @@ func processChunkBalanced(asset workStruct, numChunks int, trim bool) *pansearch
 
 	// Trim the chunk
 	if trim {
-		log.Println(`Trimming chunk`, asset.chunkId, `of`, numChunks)
+		log.Println(`Trimming chunk`, asset.chunkId)
 		if multithreaded {
 			tokens.Build_With_Min_Multithreaded(minOccurPerChunk)
 		} else {
@@ -1471,15 +1687,15 @@ func processChunkBalanced(asset workStruct, numChunks int, trim bool) *pansearch
 		runtime.GC()
 	}
 
-	//log.Println(`Completed chunk`, asset.chunkId, `of`, numChunks)
+	//log.Println(`Completed chunk`, asset.chunkId)
 	return tokens
 }
 
-func processChunkConsistent(asset workStruct, numChunks int, trim bool) *pansearch.Counter {
-	log.Println(`Finding tokens in chunk`, asset.chunkId, `of`, numChunks)
+func processChunkConsistent(asset workStruct, trim bool) *pansearch.Counter {
+	log.Println(`Finding tokens in chunk`, asset.chunkId)
 	tokens := asset.tokens
 	lastMicroChunk := len(asset.data) - 1
-	var i, l, length int
+	var i, l, length, next int
 	var max int = maxTokenLength
 	var maxTokenLengthEffective int = maxTokenLength + 1
 	var okay bool
@@ -1491,9 +1707,22 @@ func processChunkConsistent(asset workStruct, numChunks int, trim bool) *pansear
 		// Move forward one character at a time capturing all possible combinations of characters from 2 to maxTokenLength
 		
 		_ = data[0 : l + maxTokenLengthEffective] // infer to the optimizer that we don't access beyond this
+		next = nextDelimiter(data, 0)
 		for i = 0; i < l; i++ {
+			if i >= next {
+				if i >= next + len(docDelimiter) {
+					next = nextDelimiter(data, i)
+				}
+				if i >= next { // inside the document delimiter
+					continue
+				}
+			}
 			charTable[data[i]]++ // single characters recorded separately
-			for length = maxTokenLengthEffective; length >= 3; length-- {
+			length = maxTokenLengthEffective
+			if next + 1 - i < length { // the first byte of the delimiter can be the character after the token
+				length = next + 1 - i
+			}
+			for ; length >= 3; length-- {
 				if clean, okay = filterConsistent(data[i:i+length]); okay {
 					if len(clean) >= 2 && len(clean) <= max {
 						tokens.Add(clean, 1)
@@ -1524,7 +1753,7 @@ func processChunkConsistent(asset workStruct, numChunks int, trim bool) *pansear
 
 	// Trim the chunk
 	if trim {
-		log.Println(`Trimming chunk`, asset.chunkId, `of`, numChunks)
+		log.Println(`Trimming chunk`, asset.chunkId)
 		if multithreaded {
 			tokens.Build_With_Min_Multithreaded(minOccurPerChunk)
 		} else {
@@ -1534,15 +1763,15 @@ func processChunkConsistent(asset workStruct, numChunks int, trim bool) *pansear
 		runtime.GC()
 	}
 
-	//log.Println(`Completed chunk`, asset.chunkId, `of`, numChunks)
+	//log.Println(`Completed chunk`, asset.chunkId)
 	return tokens
 }
 
-func processChunkStrict(asset workStruct, numChunks int, trim bool) *pansearch.Counter {
-	log.Println(`Finding tokens in chunk`, asset.chunkId, `of`, numChunks)
+func processChunkStrict(asset workStruct, trim bool) *pansearch.Counter {
+	log.Println(`Finding tokens in chunk`, asset.chunkId)
 	tokens := asset.tokens
 	lastMicroChunk := len(asset.data) - 1
-	var i, l, length int
+	var i, l, length, next int
 	var max int = maxTokenLength
 	var maxTokenLengthEffective int = maxTokenLength + 1
 	var okay bool
@@ -1554,9 +1783,22 @@ func processChunkStrict(asset workStruct, numChunks int, trim bool) *pansearch.C
 		// Move forward one character at a time capturing all possible combinations of characters from 2 to maxTokenLength
 		
 		_ = data[0 : l + maxTokenLengthEffective] // infer to the optimizer that we don't access beyond this
+		next = nextDelimiter(data, 0)
 		for i = 0; i < l; i++ {
+			if i >= next {
+				if i >= next + len(docDelimiter) {
+					next = nextDelimiter(data, i)
+				}
+				if i >= next { // inside the document delimiter
+					continue
+				}
+			}
 			charTable[data[i]]++ // single characters recorded separately
-			for length = maxTokenLengthEffective; length >= 3; length-- {
+			length = maxTokenLengthEffective
+			if next + 1 - i < length { // the first byte of the delimiter can be the character after the token
+				length = next + 1 - i
+			}
+			for ; length >= 3; length-- {
 				if clean, okay = filterStrict(data[i:i+length]); okay {
 					if len(clean) >= 2 && len(clean) <= max {
 						tokens.Add(clean, 1)
@@ -1587,7 +1829,7 @@ func processChunkStrict(asset workStruct, numChunks int, trim bool) *pansearch.C
 
 	// Trim the chunk
 	if trim {
-		log.Println(`Trimming chunk`, asset.chunkId, `of`, numChunks)
+		log.Println(`Trimming chunk`, asset.chunkId)
 		if multithreaded {
 			tokens.Build_With_Min_Multithreaded(minOccurPerChunk)
 		} else {
@@ -1597,7 +1839,7 @@ func processChunkStrict(asset workStruct, numChunks int, trim bool) *pansearch.C
 		runtime.GC()
 	}
 
-	//log.Println(`Completed chunk`, asset.chunkId, `of`, numChunks)
+	//log.Println(`Completed chunk`, asset.chunkId)
 	return tokens
 }
 
@@ -1611,7 +1853,7 @@ func containsOnlyNumbers(input string) bool {
 }
 
 func main() {
-	flag.StringVar(&datasetFilename, "dataset", datasetFilename, "filename of the dataset plain-text (required)")
+	flag.StringVar(&datasetFilename, "dataset", datasetFilename, "filename of the dataset plain-text, a directory or glob of them, a YAML or JSON manifest of weighted sources, or - for stdin (required)")
 	flag.StringVar(&saveFilename, "output", saveFilename, "output filename for the dictionary (required)")
 	flag.StringVar(&charset, "charset", charset, "one of: UTF-8, none (default UTF-8)")
 	flag.StringVar(&normFlag, "norm", normFlag, "combine any of the following: NFD, lowercase, accents, quotemarks, collapse, trim, leadingspace, newlines (default NFD)")
@@ -1628,13 +1870,25 @@ func main() {
 	flag.IntVar(&minOccurSingles, "min-occur-byte", minOccurSingles, "single bytes will be trimmed if they occur less frequently than this in the dataset (default min-occur)")
 	flag.StringVar(&levelFlag, "mode", levelFlag, "0 = unfiltered, 1 = clean, 2 = balanced, 3 = consistent, 4 = strict (required)")
 	flag.IntVar(&wordsPerToken, "words-per-token", wordsPerToken, "maximum number of words that can be in a single token (default unlimited)")
+	flag.StringVar(&textField, "text-field", textField, "the field containing the text in each record of a JSONL dataset")
+	flag.StringVar(&docSeparatorFlag, "doc-separator", docSeparatorFlag, "what separates the records of a JSONL dataset: boundary = the document delimiter, newline, or paragraph (default boundary)")
+	flag.StringVar(&docDelimiterFlag, "doc-delimiter", docDelimiterFlag, "tokens never span this byte sequence, which separates documents in the dataset: nul, or escaped text such as <|endoftext|> or \\n\\n\\n (default nul between JSONL records, otherwise none)")
 	flag.Parse()
+	var err error
 	flagRequired("dataset", datasetFilename)
 	flagRequired("output", saveFilename)
 	flagRequired("mode", levelFlag)
 
+	if docSeparator, err = dataset.ParseSeparator(docSeparatorFlag); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if docDelimiterRaw, err = dataset.ParseDelimiter(docDelimiterFlag); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
 	usingCapcode = uint8(capcodeFlag)
-	var err error
 	normalizer, err = norm.NewNormalizer(normFlag)
 	if err != nil {
 		fmt.Fprintln(os.Stdout, err)
@@ -1809,122 +2063,90 @@ func main() {
 		}
 	}
 
-	// Load the text & normalize
-	log.Println(`Loading`, datasetFilename)
-	filedata, err := ioutil.ReadFile(datasetFilename)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Dataset file does not exist or cannot be opened: " + datasetFilename + "\n")
-		os.Exit(1)
-	}
-	filedata = normalize(filedata)
-
-	if minOccurTotal == 0 {
-		minOccurTotal = len(filedata) / 10000000
-		if minOccurTotal < 1 {
-			minOccurTotal = 1
+	// Open the dataset, which is read and normalized one chunk at a time
+	var input io.Reader = os.Stdin
+	var datasetSize int64
+	if datasetFilename != `-` {
+		opt := dataset.Options{TextField: textField, Separator: docSeparator, Delimiter: docDelimiterRaw}
+		if input, datasetSize, err = opt.Open(datasetFilename); err != nil {
+			fmt.Fprintf(os.Stderr, "Dataset cannot be opened: %s\n", err.Error())
+			os.Exit(1)
 		}
-		fmt.Println(`-min-occur set to`, minOccurTotal)
+		if closer, ok := input.(io.Closer); ok {
+			defer closer.Close()
+		}
+		docDelimiterRaw = opt.Delimiter
 	}
-	if minOccurSingles == 0 {
-		minOccurSingles = minOccurTotal
+	if len(docDelimiterRaw) > 0 {
+		if docDelimiter = dataset.NormalizeDelimiter(docDelimiterRaw, normalize); docDelimiter == nil {
+			fmt.Fprintln(os.Stderr, `The document delimiter is empty once normalized`)
+			os.Exit(1)
+		}
 	}
+	log.Println(`Reading`, datasetFilename)
+	datasetIn := &datasetReader{reader:input}
 
-	chunkSize += 4 - (chunkSize % 4) // ensure it's divisible by 4 to avoid splitting glyphs
-	numChunks := (len(filedata) / chunkSize)
-	if (numChunks * chunkSize) < len(filedata) {
-		numChunks++
-	}
 	microChunkSize := chunkSize / microChunks
-	microChunkSize += 4 - (microChunkSize % 4) // ensure it's divisible by 4 to avoid splitting glyphs
-
-	var i, i2, thisto int
-
-	// Split the data into chunks & microchunks
-	var from = 0
-	var to = microChunkSize
-	data_chunk := make([][][]byte, numChunks)
-	for i=0; i<numChunks; i++ {
-		data_chunk[i] = make([][]byte, microChunks)
-		thisto = from + chunkSize
-		if len(filedata) < thisto {
-			thisto = len(filedata)
-		}
-		for i2=0; i2<microChunks; i2++ {
-			to = from + microChunkSize
-			if thisto < to {
-				to = thisto
-			}
-			data_chunk[i][i2] = filedata[from:to]
-			from = to
-		}
+	if microChunkSize < 1 {
+		microChunkSize = 1
 	}
-	filedata = nil
 
 	// Get the results
+	var chunk [][]byte
+	var last bool
+	var chunkId int
 	tokens := new(pansearch.Counter)
 	startTime := time.Now()
-	to = numChunks - 1
-	for i=0; i<to; i++ {
+	for !last {
+		if chunk, last, err = datasetIn.nextChunk(chunkSize, microChunkSize); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading dataset: %s\n", err.Error())
+			os.Exit(1)
+		}
+		chunkId++
+		if datasetSize > 0 {
+			log.Println(`Read`, formatInt(datasetIn.read), `of`, formatInt(int(datasetSize)), `bytes`)
+		}
 		switch level {
 			case 0:
-				tokens = processChunkUnfiltered(workStruct{i+1, data_chunk[i], tokens}, numChunks, true)
+				tokens = processChunkUnfiltered(workStruct{chunkId, chunk, tokens}, !last)
 			case 1:
 				if multithreaded {
-					tokens = processChunkMulti(workStruct{i+1, data_chunk[i], tokens}, numChunks, true, level)
+					tokens = processChunkMulti(workStruct{chunkId, chunk, tokens}, !last, level)
 				} else {
-					tokens = processChunkClean(workStruct{i+1, data_chunk[i], tokens}, numChunks, true)
+					tokens = processChunkClean(workStruct{chunkId, chunk, tokens}, !last)
 				}
 			case 2:
 				if multithreaded {
-					tokens = processChunkMulti(workStruct{i+1, data_chunk[i], tokens}, numChunks, true, level)
+					tokens = processChunkMulti(workStruct{chunkId, chunk, tokens}, !last, level)
 				} else {
-					tokens = processChunkBalanced(workStruct{i+1, data_chunk[i], tokens}, numChunks, true)
+					tokens = processChunkBalanced(workStruct{chunkId, chunk, tokens}, !last)
 				}
 			case 3:
 				if multithreaded {
-					tokens = processChunkMulti(workStruct{i+1, data_chunk[i], tokens}, numChunks, true, level)
+					tokens = processChunkMulti(workStruct{chunkId, chunk, tokens}, !last, level)
 				} else {
-					tokens = processChunkConsistent(workStruct{i+1, data_chunk[i], tokens}, numChunks, true)
+					tokens = processChunkConsistent(workStruct{chunkId, chunk, tokens}, !last)
 				}
 			case 4:
 				if multithreaded {
-					tokens = processChunkMulti(workStruct{i+1, data_chunk[i], tokens}, numChunks, true, level)
+					tokens = processChunkMulti(workStruct{chunkId, chunk, tokens}, !last, level)
 				} else {
-					tokens = processChunkStrict(workStruct{i+1, data_chunk[i], tokens}, numChunks, true)
+					tokens = processChunkStrict(workStruct{chunkId, chunk, tokens}, !last)
 				}
 		}
-		data_chunk[i] = nil // it can be freed
+		chunk = nil // it can be freed
 	}
-	switch level {
-		case 0:
-			tokens = processChunkUnfiltered(workStruct{i+1, data_chunk[i], tokens}, numChunks, false)
-		case 1:
-			if multithreaded {
-				tokens = processChunkMulti(workStruct{i+1, data_chunk[i], tokens}, numChunks, false, level)
-			} else {
-				tokens = processChunkClean(workStruct{i+1, data_chunk[i], tokens}, numChunks, false)
-			}
-		case 2:
-			if multithreaded {
-				tokens = processChunkMulti(workStruct{i+1, data_chunk[i], tokens}, numChunks, false, level)
-			} else {
-				tokens = processChunkBalanced(workStruct{i+1, data_chunk[i], tokens}, numChunks, false)
-			}
-		case 3:
-			if multithreaded {
-				tokens = processChunkMulti(workStruct{i+1, data_chunk[i], tokens}, numChunks, false, level)
-			} else {
-				tokens = processChunkConsistent(workStruct{i+1, data_chunk[i], tokens}, numChunks, false)
-			}
-			
-		case 4:
-			if multithreaded {
-				tokens = processChunkMulti(workStruct{i+1, data_chunk[i], tokens}, numChunks, false, level)
-			} else {
-				tokens = processChunkStrict(workStruct{i+1, data_chunk[i], tokens}, numChunks, false)
-			}
+
+	if minOccurTotal == 0 {
+		minOccurTotal = datasetIn.total / 10000000
+		if minOccurTotal < 1 {
+			minOccurTotal = 1
+		}
+		fmt.Println(`-min-occur set to`, minOccurTotal)
+	}
+	if minOccurSingles == 0 {
+		minOccurSingles = minOccurTotal
 	}
-	data_chunk = nil // it can be freed
 
 	log.Println(`Tokens before final trim:`, formatInt(tokens.Len()))
 	log.Println(`Trimming final tokens for min`, minOccurTotal)
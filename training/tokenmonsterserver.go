@@ -4,14 +4,23 @@ import (
 	"io"
 	"os"
 	"fmt"
+	"net"
+	"flag"
 	"sync"
 	"time"
 	"math"
 	"bytes"
+	"bufio"
+	"errors"
 	"os/exec"
 	"syscall"
 	"runtime"
 	"strings"
+	"strconv"
+	"net/http"
+	"os/signal"
+	"sync/atomic"
+	"encoding/json"
 	"github.com/AlasdairF/Conv"
 	"github.com/alasdairforsythe/tokenmonster/go"
 )
@@ -19,7 +28,7 @@ import (
 /*
 
 	This application operates as a tokenization server that communicates via stdin & stdout.
-	It's used by the Python library and cannot be run standalone.
+	It's used by the Python library, or it can be run standalone with -listen (see LISTEN MODE below).
 
 	STATUS CODES:
 		0 = 8 bytes length
@@ -32,6 +41,9 @@ import (
 		14 = Decoder has not been initialized
 		15 = Invalid job ID
 		16 = YAML is invalid
+		17 = Too many decoders for this vocabulary
+		18 = Unable to modify the vocabulary, it's left unchanged
+		19 = Payload is larger than -max-payload, the connection is closed
 
 */
 
@@ -47,9 +59,39 @@ const ( // status codes
 	ERROR_READ_FAILED = 14
 	ERROR_INVALID_JOB = 15
 	ERROR_YAML_INVALID = 16
-	VERSION = 5
+	ERROR_TOO_MANY_DECODERS = 17
+	ERROR_MODIFY_FAILED = 18
+	ERROR_PAYLOAD_TOO_LARGE = 19
+	VERSION = 5 // reported by job_type 0 without a payload, so that existing clients keep working
+	MAX_VERSION = 6 // the highest protocol version that can be requested with job_type 0
 )
 
+var errorMessages = map[uint8]string{
+	ERROR_ID_DOES_NOT_EXIST: `ID does not exist`,
+	ERROR_ID_IS_UNLOADED: `ID has been unloaded`,
+	ERROR_FILE_CANNOT_OPEN: `Unable to open vocabulary file`,
+	ERROR_NORMALIZATION_FAILED: `Error normalizing text`,
+	ERROR_READ_FAILED: `Received corrupt data`,
+	ERROR_INVALID_JOB: `Invalid job type`,
+	ERROR_YAML_INVALID: `YAML is invalid`,
+	ERROR_TOO_MANY_DECODERS: `Too many decoders for this vocabulary`,
+	ERROR_MODIFY_FAILED: `Unable to modify the vocabulary`,
+	ERROR_PAYLOAD_TOO_LARGE: `Payload is too large`,
+}
+
+// The job types that exist, which are advertised by job_type 0 in protocol version 6
+var jobTypes = []uint8{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 14, 15, 16, 17, 18, 19, 20, 21, 22}
+
+const maxInFlight = 64 // maximum requests processed at once for each client in listen mode
+
+var batchSlots = make(chan struct{}, runtime.NumCPU()) // limits the batches being tokenized at once by all clients
+
+var decoderTimeout time.Duration // decoders unused for this long are deleted, 0 is never
+var maxDecoders int // maximum decoders for each vocabulary, 0 is unlimited
+var maxPayload uint64 = 1024 * 1024 * 1024 // largest payload accepted from a client in listen mode, or request body in HTTP mode, 0 is unlimited
+
+var errTruncated = errors.New(`payload is truncated`)
+
 type work struct {
 	data []byte
 	err error
@@ -60,7 +102,8 @@ type workCount struct {
 	err error
 }
 
-var lastAccess int64
+var lastAccess int64 // accessed atomically
+var startTime = time.Now()
 
 func readUint64(buf []byte) uint64 {
 	return uint64(buf[0]) | uint64(buf[1])<<8 | uint64(buf[2])<<16 | uint64(buf[3])<<24 | uint64(buf[4])<<32 | uint64(buf[5])<<40 | uint64(buf[6])<<48 | uint64(buf[7])<<56
@@ -147,7 +190,7 @@ func zombieController(parentPID string) {
 	for {
 		time.Sleep(time.Hour * 2)
 		sixHoursAgo := time.Now().Unix() - 21600
-		if lastAccess < sixHoursAgo { // lastAccess does not need to be atomic in this very specific circumstance
+		if atomic.LoadInt64(&lastAccess) < sixHoursAgo {
 			if !isProcessRunning(parentPID) {
 				os.Exit(0)
 			}
@@ -176,7 +219,7 @@ func readBlock(buf []byte) {
 			os.Exit(1)
 		}
 
-		lastAccess = time.Now().Unix()
+		atomic.StoreInt64(&lastAccess, time.Now().Unix())
 		return
 	}
 }
@@ -200,6 +243,11 @@ func main() {
 	job_type 0
 		Returns VERSION
 			Only responds header with version number
+		Or with a payload, negotiates the protocol version for this client:
+			4 bytes = requested protocol version
+		Responds header with length, then:
+			4 bytes = the protocol version that will be used, which is no higher than MAX_VERSION
+			32 bytes = capability flags, bit (job_type & 7) of byte (job_type >> 3) is set for each job type that exists
 
 	job_type 1
 		Tokenize
@@ -218,6 +266,7 @@ func main() {
 	job_type 5
 		New Decoder
 			No payload
+			Only responds header with ID, or 17 if -max-decoders has been reached for this vocabulary
 
 	job_type 6
 		Delete Decoder
@@ -227,21 +276,40 @@ func main() {
 		Decoder decode
 			(no batches, length is as the header so:)
 			data * length
+		Responds with the UTF-8 that is complete, incomplete characters are held back until the next chunk
+
+	job_type 21
+		Close Decoder
+			No payload
+		Responds header with length, then the held back remainder, and deletes the decoder
+
+	job_type 22
+		Stats
+			No payload
+		Responds header with length, then JSON:
+			uptime_seconds, last_access_age_seconds, goroutines, decoders (total live decoders),
+			memory: alloc_bytes, sys_bytes, heap_inuse_bytes, num_gc
+			vocabs: for each loaded vocabulary: id, requests, bytes_in, bytes_out, tokens, decoders,
+				latency: buckets_seconds (upper bounds), counts (per bucket, the last is +Inf), sum_seconds
+		Only job_type 1-4, 7-9, 20 and the HTTP tokenize, count & decode requests are counted
 
 	job_type 10
 		Load vocab
 			1 byte = filename length
 			Then filename
+			If filename is "-" then the vocabulary file follows the filename
 			Only responds header with ID
 
 	job_type 11
 		Unload vocab
+			Its decoders are also unloaded
 			Only responds header
 
 	job_type 12
 		Save vocab
 			1 byte = filename bytes length
 			Then filename bytes
+			If filename is "-" then it responds header with length, then the vocabulary file
 
 	job_type 14
 		Change tokenizer
@@ -285,42 +353,956 @@ func main() {
 		Export YAML from vocab
 			No payload
 
+	job_type 20
+		Tokenize count
+			4 bytes = number of batches
+			Then for each batch:
+				8 bytes = length
+				data * length
+
+	PROTOCOL VERSION 6:
+		Clients opt in by sending job_type 0 with the payload 6.
+		Every error status (10 and above) is followed by a UTF-8 error message, with its length in the header.
+		job_type 1 and 20 respond header with length, then:
+			4 bytes = number of batches
+			Then for each batch:
+				1 byte = status (0, or 13 if the text could not be normalized)
+				8 bytes = number of characters for which there were no tokens (missing)
+				8 bytes = length
+				data * length (job_type 1: the tokens, job_type 20: 8 bytes number of tokens, or the UTF-8 error message if status is not 0)
+
+	LISTEN MODE:
+		With -listen unix:///path/to/socket or -listen tcp://host:port the server accepts many concurrent clients.
+		It uses the same protocol, except that every request is preceded by a 4 byte request ID,
+		and every response is preceded by the 4 byte request ID of the request it responds to.
+		Requests on a connection are processed concurrently, so responses can be returned out of order.
+		Vocabulary IDs are shared by all connections.
+		Decoder jobs (5-9 & 21) are processed in the order they are received on the connection,
+		so a client can push chunks of tokens to a decoder without waiting for each response.
+		Decoders created by a connection are deleted when it closes.
+		-max-payload sets the largest payload in bytes that is accepted (default 1GB, 0 is unlimited),
+		a larger request is responded 19 and the connection is closed.
+
+	DECODERS:
+		-decoder-timeout deletes decoders that have not been used for that duration (e.g. 10m).
+		-max-decoders limits the number of decoders for each vocabulary.
+		A deleted decoder responds 11 to any further jobs.
+
+	HTTP MODE:
+		With -http host:port the server provides a REST API with JSON responses, errors are {"error": "message"}.
+		It can be used together with -listen, in which case vocabulary IDs are shared.
+		Texts are UTF-8, also for UTF-16 vocabularies, and request bodies are limited by -max-payload.
+		GET /v1/vocabs
+			List the loaded vocabularies
+		POST /v1/vocabs
+			Load a vocabulary: {"path": "filename"} as application/json, a YAML vocabulary as application/yaml, or otherwise the vocabulary file
+		GET /v1/vocabs/{id}
+			Information about the vocabulary
+		DELETE /v1/vocabs/{id}
+			Unload the vocabulary and its decoders
+		GET /v1/vocabs/{id}/yaml?order_by_score=true
+			Export the vocabulary in YAML format
+		PUT /v1/vocabs/{id}/yaml
+			Modify the vocabulary by YAML
+		POST /v1/tokenize?vocab={id}
+			Tokenize a JSON array of strings as application/json, or otherwise the body as one text
+			Responds {"tokens": [[...], ...], "missing": [...]}
+		POST /v1/count?vocab={id}
+			As tokenize, responds {"counts": [...], "missing": [...]}
+		POST /v1/decode?vocab={id}&encoding_length=2
+			Decode a JSON array of arrays of token IDs (or one array) as application/json, or otherwise serialized tokens
+			Responds {"texts": [...]}
+		GET /v1/tokens?vocab={id}
+			List all tokens, as job_type 15
+		GET /v1/stats
+			Statistics as job_type 22
+		GET /metrics
+			Statistics in Prometheus text format
+
+	METRICS:
+		With -metrics host:port the Prometheus /metrics endpoint is served on its own, e.g. alongside -listen.
+
 */
 
-	if len(os.Args) < 2 {
+	var listen, httpAddress string
+	flag.StringVar(&listen, "listen", listen, "unix:///path/to/socket or tcp://host:port to accept concurrent clients, instead of stdin & stdout (optional)")
+	flag.StringVar(&httpAddress, "http", httpAddress, "address to serve the HTTP/JSON API on, e.g. 127.0.0.1:8080, instead of stdin & stdout (optional)")
+	flag.DurationVar(&decoderTimeout, "decoder-timeout", decoderTimeout, "delete decoders that have not been used for this duration, e.g. 10m (optional)")
+	flag.IntVar(&maxDecoders, "max-decoders", maxDecoders, "maximum number of decoders for each vocabulary (optional)")
+	flag.Uint64Var(&maxPayload, "max-payload", maxPayload, "largest payload in bytes accepted from a client in listen mode, or request body in HTTP mode, 0 is unlimited (optional)")
+	var metricsAddress string
+	flag.StringVar(&metricsAddress, "metrics", metricsAddress, "address to serve Prometheus metrics on at /metrics, e.g. 127.0.0.1:9100 (optional)")
+	flag.Parse()
+
+	srv := new(server)
+	atomic.StoreInt64(&lastAccess, time.Now().Unix())
+	if decoderTimeout > 0 {
+		go srv.expireDecoders()
+	}
+	if len(metricsAddress) > 0 {
+		go func() {
+			if err := http.ListenAndServe(metricsAddress, http.HandlerFunc(srv.serveMetrics)); err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				os.Exit(1)
+			}
+		}()
+	}
+
+	if len(httpAddress) > 0 {
+		httpServer := &http.Server{Addr: httpAddress, Handler: http.HandlerFunc(srv.serveHTTP)}
+		if len(listen) == 0 {
+			fmt.Fprintln(os.Stderr, `TMS VERSION`, VERSION, `serving HTTP on`, httpAddress)
+			if err := httpServer.ListenAndServe(); err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				os.Exit(1)
+			}
+			return
+		}
+		go func() {
+			if err := httpServer.ListenAndServe(); err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				os.Exit(1)
+			}
+		}()
+	}
+
+	if len(listen) > 0 {
+		if err := srv.listen(listen); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flag.NArg() < 1 {
 		fmt.Println(`This application is a subprocess to accelerate the TokenMonster python library.`)
 		fmt.Println(`TMS VERSION`, VERSION)
 		fmt.Println(`Exiting`)
 		os.Exit(0)
 	}
-	lastAccess = time.Now().Unix()
-	go zombieController(strings.TrimSpace(os.Args[1]))
+	go zombieController(strings.TrimSpace(flag.Arg(0)))
+	srv.serveStdio()
+}
+
+type sharedVocab struct {
+	sync.RWMutex // write lock is held while the vocabulary is modified
+	vocab *tokenmonster.Vocab
+	decoders int // number of decoders, guarded by server.mu
+	stats vocabStats
+}
+
+type sharedDecoder struct {
+	sync.Mutex
+	decoder *tokenmonster.Decoder
+	parent *sharedVocab
+	lastUsed int64 // accessed atomically
+}
+
+// The vocabularies and decoders, which are shared by all clients
+// IDs are never reused, so that a client holding a deleted ID is responded 11 instead of reaching another client's vocabulary or decoder
+type server struct {
+	mu sync.RWMutex
+	vocabs []*sharedVocab // indexed by ID, nil once unloaded
+	decoders map[uint32]*sharedDecoder
+	nextDecoder uint32 // the ID of the next decoder, all IDs below it have been used
+}
 
+// Returns the vocabulary, or nil and the status code
+func (s *server) getVocab(id uint32) (*sharedVocab, uint8) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if id >= uint32(len(s.vocabs)) {
+		return nil, ERROR_ID_DOES_NOT_EXIST
+	}
+	if s.vocabs[id] == nil {
+		return nil, ERROR_ID_IS_UNLOADED
+	}
+	return s.vocabs[id], 0
+}
+
+// Returns the decoder, or nil and the status code
+func (s *server) getDecoder(id uint32) (*sharedDecoder, uint8) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if id >= s.nextDecoder {
+		return nil, ERROR_ID_DOES_NOT_EXIST
+	}
+	shared := s.decoders[id]
+	if shared == nil {
+		return nil, ERROR_ID_IS_UNLOADED
+	}
+	atomic.StoreInt64(&shared.lastUsed, time.Now().Unix())
+	return shared, 0
+}
+
+// Adds the vocabulary and returns its ID
+func (s *server) addVocab(vocab *tokenmonster.Vocab) uint32 {
+	s.mu.Lock()
+	id := uint32(len(s.vocabs))
+	s.vocabs = append(s.vocabs, &sharedVocab{vocab: vocab})
+	s.mu.Unlock()
+	return id
+}
+
+// Unloads the vocabulary and deletes its decoders, returns false if the ID does not exist
+func (s *server) deleteVocab(id uint32) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if id >= uint32(len(s.vocabs)) {
+		return false
+	}
+	parent := s.vocabs[id]
+	if parent == nil {
+		return true
+	}
+	s.vocabs[id] = nil
+	for i, shared := range s.decoders {
+		if shared.parent == parent {
+			delete(s.decoders, i)
+		}
+	}
+	parent.decoders = 0
+	return true
+}
+
+// Adds a decoder for the vocabulary and returns its ID, or false if the vocabulary already has maxDecoders
+func (s *server) addDecoder(parent *sharedVocab, decoder *tokenmonster.Decoder) (uint32, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if maxDecoders > 0 && parent.decoders >= maxDecoders {
+		return 0, false
+	}
+	parent.decoders++
+	if s.decoders == nil {
+		s.decoders = make(map[uint32]*sharedDecoder)
+	}
+	id := s.nextDecoder
+	s.nextDecoder++
+	s.decoders[id] = &sharedDecoder{decoder: decoder, parent: parent, lastUsed: time.Now().Unix()}
+	return id, true
+}
+
+// Deletes the decoder, if shared is not nil it's only deleted if the ID still belongs to it
+// Returns the decoder that was deleted, or nil
+func (s *server) deleteDecoder(id uint32, shared *sharedDecoder) *sharedDecoder {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current := s.decoders[id]
+	if current == nil || (shared != nil && current != shared) {
+		return nil
+	}
+	current.parent.decoders--
+	delete(s.decoders, id)
+	return current
+}
+
+// Deletes decoders that have not been used within decoderTimeout
+func (s *server) expireDecoders() {
+	interval := decoderTimeout / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for {
+		time.Sleep(interval)
+		expired := time.Now().Add(-decoderTimeout).Unix()
+		s.mu.RLock()
+		var ids []uint32
+		for id, shared := range s.decoders {
+			if atomic.LoadInt64(&shared.lastUsed) < expired {
+				ids = append(ids, id)
+			}
+		}
+		s.mu.RUnlock()
+		for _, id := range ids {
+			s.mu.RLock()
+			shared := s.decoders[id]
+			s.mu.RUnlock()
+			if shared != nil && atomic.LoadInt64(&shared.lastUsed) < expired { // it may have been used since
+				s.deleteDecoder(id, shared)
+			}
+		}
+	}
+}
+
+// Runs fn for each of n batches in parallel, with no more than batchSlots running at once across the server
+// A panic in fn is raised again by the calling goroutine once all batches are done, so that handleRequest recovers it
+func forEachBatch(n int, fn func(i int)) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failure interface{}
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		batchSlots <- struct{}{}
+		go func(i int) {
+			defer func() {
+				if r := recover(); r != nil {
+					mu.Lock()
+					if failure == nil {
+						failure = r
+					}
+					mu.Unlock()
+				}
+				<-batchSlots
+				wg.Done()
+			}()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+	if failure != nil {
+		panic(failure)
+	}
+}
+
+// Writes the status code, in protocol version 6 it's followed by the error message
+func writeError(w *bytes.Buffer, statusCode uint8, version uint32, err error) {
+	header9 := make([]byte, 9)
+	header9[0] = statusCode
+	if version < 6 {
+		w.Write(header9)
+		return
+	}
+	msg := errorMessages[statusCode]
+	if err != nil {
+		msg += `: ` + err.Error()
+	}
+	writeUint64(header9[1:], uint64(len(msg)))
+	w.Write(header9)
+	w.WriteString(msg)
+}
+
+// The result of one batch in protocol version 6
+type batchResult struct {
+	data []byte
+	missing int
+	err error
+}
+
+// Writes the batches for protocol version 6, each is the status, the number of characters with no tokens, and the data or error message
+func writeBatchResults(w *bytes.Buffer, results []batchResult) {
+	header17 := make([]byte, 17)
+	var length uint64 = 4
+	for i, _ := range results {
+		if results[i].err != nil {
+			results[i].data = []byte(results[i].err.Error())
+		}
+		length += 17 + uint64(len(results[i].data))
+	}
+	header17[0] = HEADER_IS_LENGTH
+	writeUint64(header17[1:], length)
+	writeUint32(header17[9:], uint32(len(results)))
+	w.Write(header17[0:13])
+	for _, result := range results {
+		header17[0] = HEADER_IS_LENGTH
+		if result.err != nil {
+			header17[0] = ERROR_NORMALIZATION_FAILED
+		}
+		writeUint64(header17[1:], uint64(result.missing))
+		writeUint64(header17[9:], uint64(len(result.data)))
+		w.Write(header17)
+		w.Write(result.data)
+	}
+}
+
+// Reads a list of 1 byte length prefixed strings, beginning with the 4 byte number of them
+// Returns errTruncated if the data is shorter than the list says
+func readList8(data []byte) ([][]byte, []byte, error) {
+	if len(data) < 4 {
+		return nil, data, errTruncated
+	}
+	numBatches := uint64(readUint32(data))
+	data = data[4:]
+	if numBatches == 0 {
+		return nil, data, nil
+	}
+	if numBatches > uint64(len(data)) { // each is at least 1 byte
+		return nil, data, errTruncated
+	}
+	list := make([][]byte, numBatches)
+	var l uint64
+	for i, _ := range list {
+		if len(data) == 0 {
+			return nil, data, errTruncated
+		}
+		l = uint64(data[0])
+		if l + 1 > uint64(len(data)) {
+			return nil, data, errTruncated
+		}
+		list[i] = data[1:l+1]
+		data = data[l+1:]
+	}
+	return list, data, nil
+}
+
+// Reads the batches of job types 1-4 & 20
+// Returns errTruncated if the data is shorter than the batches say
+func readBatches(data []byte) ([][]byte, error) {
+	if len(data) < 4 {
+		return nil, errTruncated
+	}
+	numBatches := uint64(readUint32(data))
+	data = data[4:]
+	if numBatches > uint64(len(data)) / 8 { // each has an 8 byte length
+		return nil, errTruncated
+	}
+	bodies := make([][]byte, numBatches)
+	var length uint64
+	for i, _ := range bodies {
+		if len(data) < 8 {
+			return nil, errTruncated
+		}
+		length = readUint64(data)
+		data = data[8:]
+		if length > uint64(len(data)) {
+			return nil, errTruncated
+		}
+		bodies[i] = data[0:length]
+		data = data[length:]
+	}
+	return bodies, nil
+}
+
+// Processes one job and writes the response to w
+// writeBuffer is optional and can be reused when jobs are not processed concurrently
+// protocol is the protocol version of the client, which is changed by job_type 0
+func (s *server) handle(jobType uint8, id uint32, data []byte, w *bytes.Buffer, writeBuffer []byte, protocol *uint32) {
 	header13 := make([]byte, 13)
 	header12 := header13[0:12]
 	header9 := header13[0:9]
 	header8 := header13[0:8]
+	var statusCode, encodingLength uint8
+	var length uint64
 	var err error
-	var jobType, statusCode, encodingLength uint8
+	version := atomic.LoadUint32(protocol)
+	// Statistics for the jobs that tokenize or decode
+	var stats *vocabStats
+	var tokens int
+	start := time.Now()
+	startLen := w.Len()
+	defer func() {
+		if stats != nil {
+			stats.record(time.Since(start), len(data), w.Len() - startLen, tokens)
+		}
+	}()
+
+	switch jobType {
+		case 0: // Get VERSION
+			if len(data) < 4 {
+				header9[0] = HEADER_IS_ID
+				writeUint32(header9[1:], VERSION)
+				w.Write(header9)
+				return
+			}
+			// Negotiate the protocol version
+			version = readUint32(data)
+			if version > MAX_VERSION {
+				version = MAX_VERSION
+			}
+			if version < VERSION {
+				version = VERSION
+			}
+			atomic.StoreUint32(protocol, version)
+			header9[0] = HEADER_IS_LENGTH
+			writeUint64(header9[1:], 36)
+			w.Write(header9)
+			capabilities := make([]byte, 36)
+			writeUint32(capabilities, version)
+			for _, v := range jobTypes {
+				capabilities[4 + (v >> 3)] |= 1 << (v & 7)
+			}
+			w.Write(capabilities)
+
+		case 1: // Tokenize
+			statusCode = HEADER_IS_LENGTH
+			shared, errCode := s.getVocab(id)
+			if shared == nil {
+				writeError(w, errCode, version, nil)
+				return
+			}
+			stats = &shared.stats
+			shared.RLock()
+			defer shared.RUnlock()
+			vocab := shared.vocab
+			encodingLength = 2
+			if vocab.Len() > 65536 {
+				encodingLength = 4
+			}
+			bodies, err := readBatches(data)
+			if err != nil {
+				writeError(w, ERROR_READ_FAILED, version, err)
+				return
+			}
+			if version >= 6 {
+				results := make([]batchResult, len(bodies))
+				forEachBatch(len(bodies), func(i int) {
+					results[i].data, _, results[i].missing, results[i].err = vocab.TokenizeToSerialized(bodies[i], encodingLength, nil)
+				})
+				for _, result := range results {
+					if result.err == nil {
+						tokens += len(result.data) / int(encodingLength)
+					}
+				}
+				writeBatchResults(w, results)
+				return
+			}
+			results := make([]work, len(bodies))
+			if len(bodies) == 1 {
+				encodedTokens, _, _, err := vocab.TokenizeToSerialized(bodies[0], encodingLength, writeBuffer)
+				results[0] = work{encodedTokens, err}
+			} else {
+				forEachBatch(len(bodies), func(i int) {
+					encodedTokens, _, _, err := vocab.TokenizeToSerialized(bodies[i], encodingLength, nil)
+					results[i] = work{encodedTokens, err}
+				})
+			}
+			for _, result := range results {
+				if result.err != nil {
+					statusCode = ERROR_NORMALIZATION_FAILED
+				}
+			}
+			length = 4
+			for i, _ := range results {
+				length += 8 + uint64(len(results[i].data))
+				tokens += len(results[i].data) / int(encodingLength)
+			}
+			header13[0] = statusCode
+			writeUint64(header13[1:], length)
+			writeUint32(header13[9:], uint32(len(results)))
+			w.Write(header13)
+			for i:=0; i<len(results); i++ {
+				writeUint64(header8, uint64(len(results[i].data)))
+				w.Write(header8)
+				w.Write(results[i].data)
+			}
+
+		case 2: // Decode 2 bytes encoding length
+			fallthrough
+		case 3: // Decode 3 bytes encoding length
+			fallthrough
+		case 4: // Decode 4 bytes encoding length
+			statusCode = HEADER_IS_LENGTH
+			shared, errCode := s.getVocab(id)
+			if shared == nil {
+				writeError(w, errCode, version, nil) // vocab ID does not exist or already closed
+				return
+			}
+			stats = &shared.stats
+			shared.RLock()
+			defer shared.RUnlock()
+			vocab := shared.vocab
+			encodingLength = jobType
+			bodies, err := readBatches(data)
+			if err != nil {
+				writeError(w, ERROR_READ_FAILED, version, err)
+				return
+			}
+			results := make([][]byte, len(bodies))
+			if len(bodies) == 1 {
+				results[0] = vocab.DecodeSerialized(bodies[0], encodingLength, writeBuffer)
+			} else {
+				forEachBatch(len(bodies), func(i int) {
+					results[i] = vocab.DecodeSerialized(bodies[i], encodingLength, nil)
+				})
+			}
+			length = 4
+			for i, _ := range results {
+				length += 8 + uint64(len(results[i]))
+			}
+			header13[0] = statusCode
+			writeUint64(header13[1:], length)
+			writeUint32(header13[9:], uint32(len(results)))
+			w.Write(header13)
+			for i:=0; i<len(results); i++ {
+				writeUint64(header8, uint64(len(results[i])))
+				w.Write(header8)
+				w.Write(results[i])
+			}
+
+		case 5: // New Decoder
+			statusCode = HEADER_IS_ID
+			shared, errCode := s.getVocab(id)
+			if shared == nil {
+				writeError(w, errCode, version, nil) // vocab ID does not exist or already closed
+				return
+			}
+			shared.RLock()
+			decoder := shared.vocab.NewDecoder()
+			shared.RUnlock()
+			var ok bool
+			if id, ok = s.addDecoder(shared, decoder); !ok {
+				writeError(w, ERROR_TOO_MANY_DECODERS, version, nil)
+				return
+			}
+			header9[0] = statusCode
+			writeUint32(header9[1:], id)
+			w.Write(header9)
+
+		case 6: // Unload Decoder
+			statusCode = HEADER_IS_EMPTY
+			if _, errCode := s.getDecoder(id); errCode == ERROR_ID_DOES_NOT_EXIST {
+				writeError(w, errCode, version, nil) // decoder ID does not exist
+				return
+			}
+			s.deleteDecoder(id, nil)
+			header9[0] = statusCode
+			w.Write(header9)
+
+		case 7: // Decoder: Decode 2 bytes encoding length
+			fallthrough
+		case 8: // Decoder: Decode 3 bytes encoding length
+			fallthrough
+		case 9: // Decoder: Decode 4 bytes encoding length
+			statusCode = HEADER_IS_LENGTH
+			encodingLength = jobType - 5
+			shared, errCode := s.getDecoder(id)
+			if shared == nil {
+				writeError(w, errCode, version, nil) // decoder ID does not exist or already closed
+				return
+			}
+			stats = &shared.parent.stats
+			shared.Lock()
+			result := shared.decoder.DecodeSerialized(data, encodingLength, writeBuffer)
+			shared.Unlock()
+			header9[0] = statusCode
+			writeUint64(header9[1:], uint64(len(result)))
+			w.Write(header9)
+			w.Write(result)
+
+		case 10: // Load vocab
+			statusCode = HEADER_IS_ID
+			var vocab *tokenmonster.Vocab
+			filename, file := readString8(data)
+			if filename == `-` {
+				vocab, err = tokenmonster.LoadFrom(bytes.NewReader(file))
+			} else {
+				vocab, err = tokenmonster.Load(filename)
+			}
+			if err != nil {
+				writeError(w, ERROR_FILE_CANNOT_OPEN, version, err)
+				return
+			}
+			id = s.addVocab(vocab)
+			header9[0] = statusCode
+			writeUint32(header9[1:], id)
+			w.Write(header9)
+
+		case 11: // Unload vocab
+			statusCode = HEADER_IS_EMPTY
+			if !s.deleteVocab(id) {
+				writeError(w, ERROR_ID_DOES_NOT_EXIST, version, nil)
+				return
+			}
+			header9[0] = statusCode
+			w.Write(header9)
+
+		case 12: // Save vocab
+			statusCode = HEADER_IS_EMPTY
+			filename, _ := readString8(data)
+			shared, errCode := s.getVocab(id)
+			if shared == nil {
+				writeError(w, errCode, version, nil) // vocab ID does not exist or already closed
+				return
+			}
+			shared.RLock()
+			defer shared.RUnlock()
+			vocab := shared.vocab
+			if filename == `-` {
+				buf := bytes.NewBuffer(writeBuffer)
+				buf.Reset()
+				if _, err = vocab.WriteTo(buf); err != nil {
+					writeError(w, ERROR_FILE_CANNOT_OPEN, version, err)
+					return
+				}
+				header9[0] = HEADER_IS_LENGTH
+				writeUint64(header9[1:], uint64(buf.Len()))
+				w.Write(header9)
+				buf.WriteTo(w)
+				return
+			}
+			if err = vocab.Save(filename); err != nil {
+				writeError(w, ERROR_FILE_CANNOT_OPEN, version, err)
+				return
+			}
+			header9[0] = statusCode
+			w.Write(header9)
+
+		case 14: // Modify vocab
+			statusCode = HEADER_IS_2VAL
+			shared, errCode := s.getVocab(id)
+			if shared == nil {
+				writeError(w, errCode, version, nil) // vocab ID does not exist or already closed
+				return
+			}
+			shared.Lock()
+			defer shared.Unlock()
+			vocab := shared.vocab
+			// Read reset tokenIDs
+			var resetTokenIds bool = data[0] == 1
+			// Read "change_unk"
+			changeUnk := data[1]
+			data = data[2:]
+			// Read "add", "delete" and "add" special
+			var toAdd, toDelete, toAddSpecial [][]byte
+			if toAdd, data, err = readList8(data); err == nil {
+				if toDelete, data, err = readList8(data); err == nil {
+					toAddSpecial, data, err = readList8(data)
+				}
+			}
+			if err == nil && len(data) < 4 {
+				err = errTruncated
+			}
+			if err != nil {
+				writeError(w, ERROR_READ_FAILED, version, err)
+				return
+			}
+			// Read "resize"
+			resize := int(readUint32(data))
+			// Do the modification, the vocabulary is put back as it was if it fails after the UNK token is changed
+			unchanged := *vocab
+			switch changeUnk {
+				case 1:
+					vocab.DisableUnkToken()
+				case 2:
+					vocab.EnableUnkToken()
+			}
+			if len(toAdd) > 0 || len(toDelete) > 0 || len(toAddSpecial) > 0 || resize > 0 || resetTokenIds {
+				if err = vocab.PrivateGenerateVocab(nil, nil, nil, toAdd, toDelete, toAddSpecial, nil, 0, ``, 0, 0, 0, resize, resetTokenIds); err != nil {
+					*vocab = unchanged
+					writeError(w, ERROR_MODIFY_FAILED, version, err)
+					return
+				}
+			}
+			header9[0] = statusCode
+			writeUint32(header9[1:], uint32(vocab.Len()))
+			writeUint32(header9[5:], uint32(vocab.HighestTokenID() + 1))
+			w.Write(header9)
+
+		case 15: // Get detailed info
+			statusCode = HEADER_IS_LENGTH
+			shared, errCode := s.getVocab(id)
+			if shared == nil {
+				writeError(w, errCode, version, nil) // vocab ID does not exist or already closed
+				return
+			}
+			shared.RLock()
+			info := shared.vocab.TokensDetailed()
+			shared.RUnlock()
+			// Get total length
+			length = 4
+			for _, v := range info {
+				length += 11 + uint64(len(v.Token)) + uint64(len(v.TokenDecoded))
+			}
+			header13[0] = statusCode
+			writeUint64(header13[1:], length)
+			writeUint32(header13[9:], uint32(len(info)))
+			w.Write(header13)
+			for _, v := range info {
+				writeUint32(header12, v.Id)
+				header12[4] = uint8(len(v.Token))
+				header12[5] = uint8(len(v.TokenDecoded))
+				header12[6] = v.Type
+				writeFloat32(header12[7:], v.Score)
+				w.Write(header12[0:11])
+				w.Write(v.Token)
+				w.Write(v.TokenDecoded)
+			}
+
+		case 16: // Delete tokens by ID
+			statusCode = HEADER_IS_2VAL
+			shared, errCode := s.getVocab(id)
+			if shared == nil {
+				writeError(w, errCode, version, nil)
+				return
+			}
+			shared.Lock()
+			defer shared.Unlock()
+			vocab := shared.vocab
+			var yml string = "delete:\n"
+			numBatches := readUint32(data)
+			for i:=uint32(0); i<numBatches; i++ {
+				data = data[4:]
+				yml += "  - id: " + conv.String(int(readUint32(data))) + "\n"
+			}
+			if err = vocab.PrivateGenerateVocab([]byte(yml), nil, nil, nil, nil, nil, nil, 0, ``, 0, 0, 0, 0, false); err != nil {
+				writeError(w, ERROR_MODIFY_FAILED, version, err)
+				return
+			}
+			header9[0] = statusCode
+			writeUint32(header9[1:], uint32(vocab.Len()))
+			writeUint32(header9[5:], uint32(vocab.HighestTokenID() + 1))
+			w.Write(header9)
+
+		case 17: // Modify by YAML
+			statusCode = HEADER_IS_2VAL
+			shared, errCode := s.getVocab(id)
+			if shared == nil {
+				writeError(w, errCode, version, nil)
+				return
+			}
+			shared.Lock()
+			defer shared.Unlock()
+			vocab := shared.vocab
+			err = vocab.PrivateGenerateVocab(data, nil, nil, nil, nil, nil, nil, 0, ``, 0, 0, 0, 0, false)
+			if err != nil {
+				writeError(w, ERROR_YAML_INVALID, version, err)
+				return
+			}
+			header9[0] = statusCode
+			writeUint32(header9[1:], uint32(vocab.Len()))
+			writeUint32(header9[5:], uint32(vocab.HighestTokenID() + 1))
+			w.Write(header9)
+
+		case 18: // New Vocab From YAML
+			statusCode = HEADER_IS_LENGTH
+			vocab := new(tokenmonster.Vocab)
+			err = vocab.PrivateGenerateVocab(data, nil, nil, nil, nil, nil, nil, 0, ``, 0, 0, 0, 0, false)
+			if err != nil {
+				writeError(w, ERROR_YAML_INVALID, version, err)
+			} else {
+				id = s.addVocab(vocab)
+				header9[0] = statusCode
+				writeUint64(header9[1:], 20)
+				w.Write(header9)
+				temp := make([]byte, 20)
+				temp[0] = vocab.Capcode()
+				temp[1] = vocab.Charset()
+				temp[2] = vocab.NormalizationCode()
+				temp[3] = vocab.Mode()
+				writeUint32(temp[4:], uint32(vocab.Len()))
+				writeUint32(temp[8:], id)
+				writeUint32(temp[12:], vocab.Unk())
+				writeUint32(temp[16:], uint32(vocab.HighestTokenID() + 1))
+				w.Write(temp)
+			}
+
+		case 19: // Export YAML from vocab
+			statusCode = HEADER_IS_LENGTH
+			shared, errCode := s.getVocab(id)
+			if shared == nil {
+				writeError(w, errCode, version, nil) // vocab ID does not exist or already closed
+				return
+			}
+			buf := bytes.NewBuffer(writeBuffer)
+			buf.Reset()
+			shared.RLock()
+			shared.vocab.ExportYAML(buf, data[0] == 1)
+			shared.RUnlock()
+			header9[0] = statusCode
+			writeUint64(header9[1:], uint64(buf.Len()))
+			w.Write(header9)
+			buf.WriteTo(w)
+
+		case 20: // Tokenize Count
+			statusCode = HEADER_IS_LENGTH
+			shared, errCode := s.getVocab(id)
+			if shared == nil {
+				writeError(w, errCode, version, nil)
+				return
+			}
+			stats = &shared.stats
+			shared.RLock()
+			defer shared.RUnlock()
+			vocab := shared.vocab
+			bodies, err := readBatches(data)
+			if err != nil {
+				writeError(w, ERROR_READ_FAILED, version, err)
+				return
+			}
+			if version >= 6 {
+				results := make([]batchResult, len(bodies))
+				forEachBatch(len(bodies), func(i int) {
+					var ntokens int
+					if ntokens, results[i].missing, results[i].err = vocab.Count(bodies[i]); results[i].err == nil {
+						results[i].data = make([]byte, 8)
+						writeUint64(results[i].data, uint64(ntokens))
+					}
+				})
+				for _, result := range results {
+					if result.err == nil {
+						tokens += int(readUint64(result.data))
+					}
+				}
+				writeBatchResults(w, results)
+				return
+			}
+			results := make([]workCount, len(bodies))
+			if len(bodies) == 1 {
+				ntokens, _, err := vocab.Count(bodies[0])
+				results[0] = workCount{ntokens, err}
+			} else {
+				forEachBatch(len(bodies), func(i int) {
+					ntokens, _, err := vocab.Count(bodies[i])
+					results[i] = workCount{ntokens, err}
+				})
+			}
+			for _, result := range results {
+				if result.err != nil {
+					statusCode = ERROR_NORMALIZATION_FAILED
+				}
+			}
+			length = 4 + (uint64(len(results)) * 8)
+			header13[0] = statusCode
+			writeUint64(header13[1:], length)
+			writeUint32(header13[9:], uint32(len(results)))
+			w.Write(header13)
+			for i:=0; i<len(results); i++ {
+				writeUint64(header8, uint64(results[i].data))
+				w.Write(header8)
+				tokens += results[i].data
+			}
+
+		case 21: // Close Decoder
+			statusCode = HEADER_IS_LENGTH
+			shared, errCode := s.getDecoder(id)
+			if shared == nil {
+				writeError(w, errCode, version, nil) // decoder ID does not exist or already closed
+				return
+			}
+			if s.deleteDecoder(id, shared) == nil {
+				writeError(w, ERROR_ID_IS_UNLOADED, version, nil) // closed by another request
+				return
+			}
+			shared.Lock()
+			result := shared.decoder.Flush()
+			shared.Unlock()
+			header9[0] = statusCode
+			writeUint64(header9[1:], uint64(len(result)))
+			w.Write(header9)
+			w.Write(result)
+
+		case 22: // Stats
+			statusCode = HEADER_IS_LENGTH
+			b, _ := json.Marshal(s.stats())
+			header9[0] = statusCode
+			writeUint64(header9[1:], uint64(len(b)))
+			w.Write(header9)
+			w.Write(b)
+
+		default: // Invalid job type
+			writeError(w, ERROR_INVALID_JOB, version, nil)
+	}
+}
+
+// Serves the parent process over stdin & stdout, one job at a time
+func (s *server) serveStdio() {
+	header12 := make([]byte, 12)
+	var jobType uint8
 	var length uint64
-	var i, id, numBatches uint32
-	var vocab *tokenmonster.Vocab
-	var decoder *tokenmonster.Decoder
-	var vocabs []*tokenmonster.Vocab
-	var deletedVocabs []uint32
-	var decoders []*tokenmonster.Decoder
-	var deletedDecoders []uint32
+	var id uint32
 	readBuffer := make([]byte, 1024 * 1024)
 	writeBuffer := make([]byte, 1024 * 1024)
 	var readBufferLen uint64 = uint64(len(readBuffer))
 	var data []byte
+	var protocol uint32 = VERSION
+	w := new(bytes.Buffer)
 
 	for {
 		readBlock(header12)
-		
+
 		jobType = header12[0]
 		id = readUint32(header12[1:])
 		length = readUint56(header12[5:])
+		data = nil
 		if length > 0 {
 			if length > readBufferLen {
 				data = make([]byte, length)
@@ -330,483 +1312,709 @@ func main() {
 			readBlock(data)
 		}
 
-		switch jobType {
-			case 0: // Get VERSION
-				header9[0] = HEADER_IS_ID
-				writeUint32(header9[1:], VERSION)
-				os.Stdout.Write(header9)
-			
-			case 1: // Tokenize
-				statusCode = HEADER_IS_LENGTH
-				if id >= uint32(len(vocabs)) {
-					sendError(ERROR_ID_DOES_NOT_EXIST)
-					continue
-				}
-				vocab = vocabs[id]
-				if vocab == nil {
-					sendError(ERROR_ID_IS_UNLOADED)
-					continue
-				}
-				encodingLength = 2
-				if vocab.Len() > 65536 {
-					encodingLength = 4
-				}
-				numBatches = readUint32(data)
-				data = data[4:]
-				results := make([]work, numBatches)
-				if numBatches == 1 {
-					length = readUint64(data)
-					data = data[8:]
-					body := data[0:length]
-					encodedTokens, _, _, err := vocab.TokenizeToSerialized(body, encodingLength, writeBuffer)
-					results[0] = work{encodedTokens, err}
-				} else {
-					var wg sync.WaitGroup
-					wg.Add(int(numBatches))
-					for i=0; i<numBatches; i++ {
-						length = readUint64(data)
-						data = data[8:]
-						body := data[0:length]
-						data = data[length:]
-						go func(i uint32, body []byte, encodingLength uint8) {
-							encodedTokens, _, _, err := vocab.TokenizeToSerialized(body, encodingLength, nil)
-							results[i] = work{encodedTokens, err}
-							wg.Done()
-						}(i, body, encodingLength)
-					}
-					wg.Wait()
-				}
-				if results[0].err != nil {
-					statusCode = ERROR_NORMALIZATION_FAILED
-				}
-				length = 4
-				for i, _ := range results {
-					length += 8 + uint64(len(results[i].data))
-				}
-				header13[0] = statusCode
-				writeUint64(header13[1:], length)
-				writeUint32(header13[9:], numBatches)
-				os.Stdout.Write(header13)
-				for i:=0; i<len(results); i++ {
-					writeUint64(header8, uint64(len(results[i].data)))
-					os.Stdout.Write(header8)
-					os.Stdout.Write(results[i].data)
-				}
+		w.Reset()
+		s.handle(jobType, id, data, w, writeBuffer, &protocol)
+		if _, err := os.Stdout.Write(w.Bytes()); err != nil {
+			os.Exit(1)
+		}
+		os.Stdout.Sync()
+		if w.Cap() > 64 * 1024 * 1024 { // don't keep a huge buffer around
+			w = new(bytes.Buffer)
+		}
+		atomic.StoreInt64(&lastAccess, time.Now().Unix())
+	}
+}
 
-			case 2: // Decode 2 bytes encoding length
-				fallthrough
-			case 3: // Decode 3 bytes encoding length
-				fallthrough
-			case 4: // Decode 4 bytes encoding length
-				statusCode = HEADER_IS_LENGTH
-				if id >= uint32(len(vocabs)) {
-					sendError(ERROR_ID_DOES_NOT_EXIST) // vocab ID does not exist
-					continue
-				}
-				vocab = vocabs[id]
-				if vocab == nil {
-					sendError(ERROR_ID_IS_UNLOADED) // vocab ID already closed
-					continue
-				}
-				encodingLength = jobType
-				numBatches = readUint32(data)
-				data = data[4:]
-				results := make([][]byte, numBatches)
-				if numBatches == 1 {
-					length = readUint64(data)
-					data = data[8:]
-					body := data[0:length]
-					results[0] = vocab.DecodeSerialized(body, encodingLength, writeBuffer)
-				} else {
-					var wg sync.WaitGroup
-					wg.Add(int(numBatches))
-					for i=0; i<numBatches; i++ {
-						length = readUint64(data)
-						data = data[8:]
-						body := data[0:length]
-						data = data[length:]
-						go func(i uint32, body []byte, encodingLength uint8) {
-							results[i] = vocab.DecodeSerialized(data, encodingLength, nil)
-							wg.Done()
-						}(i, body, encodingLength)
-					}
-					wg.Wait()
-				}
-				length = 4
-				for i, _ := range results {
-					length += 8 + uint64(len(results[i]))
-				}
-				header13[0] = statusCode
-				writeUint64(header13[1:], length)
-				writeUint32(header13[9:], numBatches)
-				os.Stdout.Write(header13)
-				for i:=0; i<len(results); i++ {
-					writeUint64(header8, uint64(len(results[i])))
-					os.Stdout.Write(header8)
-					os.Stdout.Write(results[i])
-				}
+// Listens on the address, which is unix:///path/to/socket or tcp://host:port
+func (s *server) listen(address string) error {
+	var network string
+	switch {
+		case strings.HasPrefix(address, `unix://`):
+			network, address = `unix`, strings.TrimPrefix(address, `unix://`)
+			// Remove a socket left behind by a previous run
+			if fi, err := os.Stat(address); err == nil && fi.Mode() & os.ModeSocket != 0 {
+				os.Remove(address)
+			}
+		case strings.HasPrefix(address, `tcp://`):
+			network, address = `tcp`, strings.TrimPrefix(address, `tcp://`)
+		default:
+			return errors.New(`-listen must be unix:///path/to/socket or tcp://host:port`)
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	// Close the listener on exit, which also removes the unix socket
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		listener.Close()
+	}()
+	fmt.Fprintln(os.Stderr, `TMS VERSION`, VERSION, `listening on`, network, address)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				time.Sleep(time.Millisecond * 10)
+				continue
+			}
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
 
-			case 5: // New Decoder
-				statusCode = HEADER_IS_ID
-				if id >= uint32(len(vocabs)) {
-					sendError(ERROR_ID_DOES_NOT_EXIST) // vocab ID does not exist
-					continue
-				}
-				vocab = vocabs[id]
-				if vocab == nil {
-					sendError(ERROR_ID_IS_UNLOADED) // vocab ID already closed
-					continue
-				}
-				decoder = vocab.NewDecoder()
-				if len(deletedDecoders) == 0 {
-					id = uint32(len(decoders))
-					decoders = append(decoders, decoder)
-				} else {
-					id = deletedDecoders[len(deletedDecoders) - 1]
-					deletedDecoders = deletedDecoders[0 : len(deletedDecoders) - 1]
-					decoders[id] = decoder
-				}
-				header9[0] = statusCode
-				writeUint32(header9[1:], id)
-				os.Stdout.Write(header9)
-
-			case 6: // Unload Decoder
-				statusCode = HEADER_IS_EMPTY
-				if id >= uint32(len(decoders)) {
-					sendError(4) // vocab ID does not exist
-					continue
-				}
-				decoders[id] = nil
-				deletedDecoders = append(deletedDecoders, id)
-				header9[0] = statusCode
-				os.Stdout.Write(header9)
-
-			case 7: // Decoder: Decode 2 bytes encoding length
-				fallthrough
-			case 8: // Decoder: Decode 3 bytes encoding length
-				fallthrough
-			case 9: // Decoder: Decode 4 bytes encoding length
-				statusCode = HEADER_IS_LENGTH
-				encodingLength = jobType - 5
-				if id >= uint32(len(decoders)) {
-					sendError(ERROR_ID_DOES_NOT_EXIST) // vocab ID does not exist
-					continue
-				}
-				decoder = decoders[id]
-				if decoder == nil {
-					sendError(ERROR_ID_IS_UNLOADED) // vocab ID already closed
-					continue
-				}
-				result := decoder.DecodeSerialized(data, encodingLength, writeBuffer)
-				header9[0] = statusCode
-				writeUint64(header9[1:], uint64(len(result)))
-				os.Stdout.Write(header9)
-				os.Stdout.Write(result)
+// Processes one job in listen mode and returns the response, beginning with the request ID
+func (s *server) handleRequest(requestID uint32, jobType uint8, id uint32, data []byte, protocol *uint32) []byte {
+	w := bytes.NewBuffer(make([]byte, 4, 4096))
+	func() {
+		defer func() {
+			if recover() != nil { // malformed payload
+				w.Truncate(4)
+				writeError(w, ERROR_READ_FAILED, atomic.LoadUint32(protocol), nil)
+			}
+		}()
+		s.handle(jobType, id, data, w, nil, protocol)
+	}()
+	response := w.Bytes()
+	writeUint32(response, requestID)
+	return response
+}
 
-			case 10: // Load vocab
-				statusCode = HEADER_IS_ID
-				filename, _ := readString8(data)
-				vocab, err = tokenmonster.Load(filename)
-				if err == nil {
-					if len(deletedVocabs) == 0 {
-						id = uint32(len(vocabs))
-						vocabs = append(vocabs, vocab)
-					} else {
-						id = deletedVocabs[len(deletedVocabs) - 1]
-						deletedVocabs = deletedVocabs[0 : len(deletedVocabs) - 1]
-						vocabs[id] = vocab
+// Serves one client, each request is processed concurrently and the responses are written as they are ready
+// Decoder jobs are processed in order by the reading goroutine, so the client is held back until each chunk is written
+// job_type 0 is also processed in order, so that the protocol version applies to all requests that follow it
+func (s *server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReaderSize(conn, 64 * 1024)
+	header := make([]byte, 16)
+	inFlight := make(chan struct{}, maxInFlight)
+	var writeMu sync.Mutex
+	var wg sync.WaitGroup
+	var protocol uint32 = VERSION // accessed atomically
+	owned := make(map[uint32]*sharedDecoder) // decoders created by this connection
+	defer func() {
+		for id, shared := range owned {
+			s.deleteDecoder(id, shared)
+		}
+	}()
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			break
+		}
+		requestID := readUint32(header)
+		jobType := header[4]
+		id := readUint32(header[5:])
+		length := readUint56(header[9:])
+		if maxPayload > 0 && length > maxPayload { // respond and close the connection, rather than reading or skipping the payload
+			w := bytes.NewBuffer(make([]byte, 4, 64))
+			writeError(w, ERROR_PAYLOAD_TOO_LARGE, atomic.LoadUint32(&protocol), nil)
+			response := w.Bytes()
+			writeUint32(response, requestID)
+			writeMu.Lock()
+			conn.Write(response)
+			writeMu.Unlock()
+			break
+		}
+		var data []byte
+		if length > 0 {
+			data = make([]byte, length)
+			if _, err := io.ReadFull(r, data); err != nil {
+				break
+			}
+		}
+		atomic.StoreInt64(&lastAccess, time.Now().Unix())
+		if jobType == 0 || (jobType >= 5 && jobType <= 9) || jobType == 21 {
+			response := s.handleRequest(requestID, jobType, id, data, &protocol)
+			switch {
+				case jobType == 5 && response[4] == HEADER_IS_ID:
+					decoderID := readUint32(response[5:])
+					if shared, _ := s.getDecoder(decoderID); shared != nil {
+						owned[decoderID] = shared
 					}
-				} else {
-					statusCode = ERROR_FILE_CANNOT_OPEN
-				}
-				header9[0] = statusCode
-				writeUint32(header9[1:], id)
-				os.Stdout.Write(header9)
-
-			case 11: // Unload vocab
-				statusCode = HEADER_IS_EMPTY
-				if id < uint32(len(vocabs)) {
-					vocabs[id] = nil
-					deletedVocabs = append(deletedVocabs, id)
-				} else {
-					statusCode = ERROR_ID_DOES_NOT_EXIST
-				}
-				header9[0] = statusCode
-				os.Stdout.Write(header9)
-
-			case 12: // Save vocab
-				statusCode = HEADER_IS_EMPTY
-				filename, _ := readString8(data)
-				if id >= uint32(len(vocabs)) {
-					sendError(ERROR_ID_DOES_NOT_EXIST) // vocab ID does not exist
-					continue
-				}
-				vocab = vocabs[id]
-				if vocab == nil {
-					sendError(ERROR_ID_IS_UNLOADED) // vocab ID already closed
-					continue
-				}
-				err = vocab.Save(filename)
-				if err != nil {
-					statusCode = ERROR_FILE_CANNOT_OPEN
-				}
-				header9[0] = statusCode
-				os.Stdout.Write(header9)
+				case jobType == 6 || jobType == 21:
+					delete(owned, id)
+			}
+			writeMu.Lock()
+			_, err := conn.Write(response)
+			writeMu.Unlock()
+			if err != nil {
+				break
+			}
+			continue
+		}
+		inFlight <- struct{}{} // blocks when too many requests are being processed for this client
+		wg.Add(1)
+		go func(requestID uint32, jobType uint8, id uint32, data []byte) {
+			defer wg.Done()
+			response := s.handleRequest(requestID, jobType, id, data, &protocol)
+			writeMu.Lock()
+			_, err := conn.Write(response)
+			writeMu.Unlock()
+			<-inFlight
+			if err != nil {
+				conn.Close()
+			}
+		}(requestID, jobType, id, data)
+	}
+	wg.Wait()
+}
 
-			case 14: // Modify vocab
-				statusCode = HEADER_IS_2VAL
-				if id >= uint32(len(vocabs)) {
-					sendError(ERROR_ID_DOES_NOT_EXIST) // vocab ID does not exist
-					continue
-				}
-				vocab = vocabs[id]
-				if vocab == nil {
-					sendError(ERROR_ID_IS_UNLOADED) // vocab ID already closed
-					continue
-				}
-				var l uintptr
-				// Read reset tokenIDs
-				var resetTokenIds bool = data[0] == 1
-				// Read "change_unk"
-				switch data[1] {
-					case 1:
-						vocab.DisableUnkToken()
-					case 2:
-						vocab.EnableUnkToken()
-				}
-				data = data[2:]
-				// Read "add"
-				var toAdd [][]byte
-				numBatches = readUint32(data)
-				data = data[4:]
-				if numBatches > 0 {
-					toAdd = make([][]byte, numBatches)
-					for i=0; i<numBatches; i++ {
-						l = uintptr(data[0])
-						toAdd[i] = data[1:l+1]
-						data = data[l+1:]
-					}
-				}
-				// Read "delete"
-				var toDelete [][]byte
-				numBatches = readUint32(data)
-				data = data[4:]
-				if numBatches > 0 {
-					toDelete = make([][]byte, numBatches)
-					for i=0; i<numBatches; i++ {
-						l = uintptr(data[0])
-						toDelete[i] = data[1:l+1]
-						data = data[l+1:]
-					}
-				}
-				// Read "add" special
-				var toAddSpecial [][]byte
-				numBatches = readUint32(data)
-				data = data[4:]
-				if numBatches > 0 {
-					toAddSpecial = make([][]byte, numBatches)
-					for i=0; i<numBatches; i++ {
-						l = uintptr(data[0])
-						toAddSpecial[i] = data[1:l+1]
-						data = data[l+1:]
-					}
-				}
-				// Read "resize"
-				resize := int(readUint32(data))
-				// Do the modification
-				if len(toAdd) > 0 || len(toDelete) > 0 || len(toAddSpecial) > 0 || resize > 0 || resetTokenIds {
-					vocab.PrivateGenerateVocab(nil, nil, nil, toAdd, toDelete, toAddSpecial, nil, 0, ``, 0, 0, 0, resize, resetTokenIds)
-				}
-				header9[0] = statusCode
-				writeUint32(header9[1:], uint32(vocab.Len()))
-				writeUint32(header9[5:], uint32(vocab.HighestTokenID() + 1))
-				os.Stdout.Write(header9)
-
-			case 15: // Get detailed info
-				statusCode = HEADER_IS_LENGTH
-				if id >= uint32(len(vocabs)) {
-					sendError(ERROR_ID_DOES_NOT_EXIST) // vocab ID does not exist
-					continue
-				}
-				vocab = vocabs[id]
-				if vocab == nil {
-					sendError(ERROR_ID_IS_UNLOADED) // vocab ID already closed
-					continue
-				}
-				info := vocab.TokensDetailed()
-				// Get total length
-				length = 4
-				for _, v := range info {
-					length += 11 + uint64(len(v.Token)) + uint64(len(v.TokenDecoded))
-				}
-				header13[0] = statusCode
-				writeUint64(header13[1:], length)
-				writeUint32(header13[9:], uint32(len(info)))
-				os.Stdout.Write(header13)
-				for _, v := range info {
-					writeUint32(header12, v.Id)
-					header12[4] = uint8(len(v.Token))
-					header12[5] = uint8(len(v.TokenDecoded))
-					header12[6] = v.Type
-					writeFloat32(header12[7:], v.Score)
-					os.Stdout.Write(header12[0:11])
-					os.Stdout.Write(v.Token)
-					os.Stdout.Write(v.TokenDecoded)
-				}
+// --------- STATS ---------
 
-			case 16: // Delete tokens by ID
-				statusCode = HEADER_IS_2VAL
-				if id >= uint32(len(vocabs)) {
-					sendError(ERROR_ID_DOES_NOT_EXIST)
-					continue
-				}
-				vocab = vocabs[id]
-				if vocab == nil {
-					sendError(ERROR_ID_IS_UNLOADED)
-					continue
-				}
-				var yml string = "delete:\n"
-				numBatches = readUint32(data)
-				for i=0; i<numBatches; i++ {
-					data = data[4:]
-					yml += "  - id: " + conv.String(int(readUint32(data))) + "\n"
-				}
-				vocab.PrivateGenerateVocab([]byte(yml), nil, nil, nil, nil, nil, nil, 0, ``, 0, 0, 0, 0, false)
-				vocabs[id] = vocab
-				header9[0] = statusCode
-				writeUint32(header9[1:], uint32(vocab.Len()))
-				writeUint32(header9[5:], uint32(vocab.HighestTokenID() + 1))
-				os.Stdout.Write(header9)
-
-			case 17: // Modify by YAML
-				statusCode = HEADER_IS_2VAL
-				if id >= uint32(len(vocabs)) {
-					sendError(ERROR_ID_DOES_NOT_EXIST)
-					continue
-				}
-				vocab = vocabs[id]
-				if vocab == nil {
-					sendError(ERROR_ID_IS_UNLOADED)
-					continue
-				}
-				err = vocab.PrivateGenerateVocab(data, nil, nil, nil, nil, nil, nil, 0, ``, 0, 0, 0, 0, false)
-				if err == nil {
-					vocabs[id] = vocab
-				} else {
-					statusCode = ERROR_YAML_INVALID
-				}
-				header9[0] = statusCode
-				writeUint32(header9[1:], uint32(vocab.Len()))
-				writeUint32(header9[5:], uint32(vocab.HighestTokenID() + 1))
-				os.Stdout.Write(header9)
+// Upper bounds in seconds of the latency histogram buckets, there is also a +Inf bucket
+var latencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// Statistics for one vocabulary, all accessed atomically
+type vocabStats struct {
+	requests uint64
+	bytesIn uint64
+	bytesOut uint64
+	tokens uint64
+	latencySum uint64 // nanoseconds
+	latency [11]uint64 // the count in each of latencyBuckets, and +Inf
+}
+
+func (st *vocabStats) record(elapsed time.Duration, bytesIn int, bytesOut int, tokens int) {
+	atomic.AddUint64(&st.requests, 1)
+	atomic.AddUint64(&st.bytesIn, uint64(bytesIn))
+	atomic.AddUint64(&st.bytesOut, uint64(bytesOut))
+	atomic.AddUint64(&st.tokens, uint64(tokens))
+	atomic.AddUint64(&st.latencySum, uint64(elapsed))
+	seconds := elapsed.Seconds()
+	i := 0
+	for ; i < len(latencyBuckets); i++ {
+		if seconds <= latencyBuckets[i] {
+			break
+		}
+	}
+	atomic.AddUint64(&st.latency[i], 1)
+}
 
-			case 18: // New Vocab From YAML
-				statusCode = HEADER_IS_LENGTH
+type latencyStats struct {
+	Buckets		[]float64	`json:"buckets_seconds"`
+	Counts		[]uint64	`json:"counts"`
+	Sum			float64		`json:"sum_seconds"`
+}
+
+type vocabStatsInfo struct {
+	Id			uint32			`json:"id"`
+	Requests	uint64			`json:"requests"`
+	BytesIn		uint64			`json:"bytes_in"`
+	BytesOut	uint64			`json:"bytes_out"`
+	Tokens		uint64			`json:"tokens"`
+	Decoders	int				`json:"decoders"`
+	Latency		latencyStats	`json:"latency"`
+}
+
+type memoryStats struct {
+	Alloc		uint64	`json:"alloc_bytes"`
+	Sys			uint64	`json:"sys_bytes"`
+	HeapInuse	uint64	`json:"heap_inuse_bytes"`
+	NumGC		uint32	`json:"num_gc"`
+}
+
+type serverStats struct {
+	Uptime			float64				`json:"uptime_seconds"`
+	LastAccessAge	int64				`json:"last_access_age_seconds"`
+	Goroutines		int					`json:"goroutines"`
+	Decoders		int					`json:"decoders"`
+	Memory			memoryStats			`json:"memory"`
+	Vocabs			[]vocabStatsInfo	`json:"vocabs"`
+}
+
+// Returns the current statistics of the server
+func (s *server) stats() serverStats {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	res := serverStats{
+		Uptime: time.Since(startTime).Seconds(),
+		LastAccessAge: time.Now().Unix() - atomic.LoadInt64(&lastAccess),
+		Goroutines: runtime.NumGoroutine(),
+		Memory: memoryStats{mem.Alloc, mem.Sys, mem.HeapInuse, mem.NumGC},
+		Vocabs: []vocabStatsInfo{},
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	res.Decoders = len(s.decoders)
+	for id, shared := range s.vocabs {
+		if shared == nil {
+			continue
+		}
+		st := &shared.stats
+		info := vocabStatsInfo{
+			Id: uint32(id),
+			Requests: atomic.LoadUint64(&st.requests),
+			BytesIn: atomic.LoadUint64(&st.bytesIn),
+			BytesOut: atomic.LoadUint64(&st.bytesOut),
+			Tokens: atomic.LoadUint64(&st.tokens),
+			Decoders: shared.decoders,
+			Latency: latencyStats{latencyBuckets, make([]uint64, len(st.latency)), time.Duration(atomic.LoadUint64(&st.latencySum)).Seconds()},
+		}
+		for i, _ := range st.latency {
+			info.Latency.Counts[i] = atomic.LoadUint64(&st.latency[i])
+		}
+		res.Vocabs = append(res.Vocabs, info)
+	}
+	return res
+}
+
+// Serves the statistics in Prometheus text format
+func (s *server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	st := s.stats()
+	var b bytes.Buffer
+	metric := func(name string, kind string, help string) {
+		fmt.Fprintf(&b, "# HELP tokenmonster_%s %s\n# TYPE tokenmonster_%s %s\n", name, help, name, kind)
+	}
+	metric(`uptime_seconds`, `gauge`, `Seconds since the server started.`)
+	fmt.Fprintf(&b, "tokenmonster_uptime_seconds %g\n", st.Uptime)
+	metric(`last_access_age_seconds`, `gauge`, `Seconds since the last request.`)
+	fmt.Fprintf(&b, "tokenmonster_last_access_age_seconds %d\n", st.LastAccessAge)
+	metric(`goroutines`, `gauge`, `Number of goroutines.`)
+	fmt.Fprintf(&b, "tokenmonster_goroutines %d\n", st.Goroutines)
+	metric(`memory_alloc_bytes`, `gauge`, `Bytes of allocated heap objects.`)
+	fmt.Fprintf(&b, "tokenmonster_memory_alloc_bytes %d\n", st.Memory.Alloc)
+	metric(`memory_sys_bytes`, `gauge`, `Bytes of memory obtained from the OS.`)
+	fmt.Fprintf(&b, "tokenmonster_memory_sys_bytes %d\n", st.Memory.Sys)
+	metric(`memory_heap_inuse_bytes`, `gauge`, `Bytes in in-use heap spans.`)
+	fmt.Fprintf(&b, "tokenmonster_memory_heap_inuse_bytes %d\n", st.Memory.HeapInuse)
+	metric(`gc_total`, `counter`, `Number of completed GC cycles.`)
+	fmt.Fprintf(&b, "tokenmonster_gc_total %d\n", st.Memory.NumGC)
+	metric(`vocabs`, `gauge`, `Number of loaded vocabularies.`)
+	fmt.Fprintf(&b, "tokenmonster_vocabs %d\n", len(st.Vocabs))
+	metric(`decoders`, `gauge`, `Number of live decoders.`)
+	fmt.Fprintf(&b, "tokenmonster_decoders %d\n", st.Decoders)
+	counters := []struct{name, help string; value func(v vocabStatsInfo) uint64}{
+		{`requests_total`, `Requests that tokenized or decoded.`, func(v vocabStatsInfo) uint64 { return v.Requests }},
+		{`bytes_in_total`, `Bytes received by requests that tokenized or decoded.`, func(v vocabStatsInfo) uint64 { return v.BytesIn }},
+		{`bytes_out_total`, `Bytes sent by requests that tokenized or decoded.`, func(v vocabStatsInfo) uint64 { return v.BytesOut }},
+		{`tokens_total`, `Tokens produced by tokenizing and counting.`, func(v vocabStatsInfo) uint64 { return v.Tokens }},
+	}
+	for _, c := range counters {
+		metric(c.name, `counter`, c.help)
+		for _, v := range st.Vocabs {
+			fmt.Fprintf(&b, "tokenmonster_%s{vocab=\"%d\"} %d\n", c.name, v.Id, c.value(v))
+		}
+	}
+	metric(`vocab_decoders`, `gauge`, `Number of live decoders for the vocabulary.`)
+	for _, v := range st.Vocabs {
+		fmt.Fprintf(&b, "tokenmonster_vocab_decoders{vocab=\"%d\"} %d\n", v.Id, v.Decoders)
+	}
+	metric(`request_duration_seconds`, `histogram`, `Latency of requests that tokenized or decoded.`)
+	for _, v := range st.Vocabs {
+		var cumulative uint64
+		for i, count := range v.Latency.Counts {
+			cumulative += count
+			le := `+Inf`
+			if i < len(latencyBuckets) {
+				le = strconv.FormatFloat(latencyBuckets[i], 'g', -1, 64)
+			}
+			fmt.Fprintf(&b, "tokenmonster_request_duration_seconds_bucket{vocab=\"%d\",le=\"%s\"} %d\n", v.Id, le, cumulative)
+		}
+		fmt.Fprintf(&b, "tokenmonster_request_duration_seconds_sum{vocab=\"%d\"} %g\n", v.Id, v.Latency.Sum)
+		fmt.Fprintf(&b, "tokenmonster_request_duration_seconds_count{vocab=\"%d\"} %d\n", v.Id, cumulative)
+	}
+	w.Header().Set(`Content-Type`, `text/plain; version=0.0.4`)
+	b.WriteTo(w)
+}
+
+// --------- HTTP ---------
+
+// Counts the bytes read from a request body
+type countingReader struct {
+	io.ReadCloser
+	n int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += n
+	return n, err
+}
+
+// Counts the bytes written to a response
+type countingResponseWriter struct {
+	http.ResponseWriter
+	n int
+}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n += n
+	return n, err
+}
+
+type httpVocabInfo struct {
+	Id				uint32	`json:"id"`
+	Capcode			uint8	`json:"capcode"`
+	Charset			uint8	`json:"charset"`
+	Normalization	string	`json:"normalization"`
+	Mode			uint8	`json:"mode"`
+	Size			int		`json:"size"`
+	Unk				*uint32	`json:"unk"`
+	HighestTokenId	int		`json:"highest_token_id"`
+}
+
+type httpToken struct {
+	Id		uint32	`json:"id"`
+	Token	string	`json:"token"`
+	Bytes	[]byte	`json:"bytes"` // the raw bytes of the token as base64, in case it's not valid UTF-8
+	Decoded	string	`json:"decoded"`
+	Type	uint8	`json:"type"`
+	Score	float32	`json:"score"`
+}
+
+type httpLoadRequest struct {
+	Path	string	`json:"path"`
+}
+
+type httpTokenizeResponse struct {
+	Tokens	[][]uint32	`json:"tokens"`
+	Missing	[]int		`json:"missing"`
+}
+
+type httpCountResponse struct {
+	Counts	[]int	`json:"counts"`
+	Missing	[]int	`json:"missing"`
+}
+
+type httpDecodeResponse struct {
+	Texts	[]string	`json:"texts"`
+}
+
+type httpError struct {
+	Error	string	`json:"error"`
+}
+
+func vocabInfo(id uint32, vocab *tokenmonster.Vocab) httpVocabInfo {
+	info := httpVocabInfo{Id: id, Capcode: vocab.Capcode(), Charset: vocab.Charset(), Normalization: vocab.Normalization(), Mode: vocab.Mode(), Size: vocab.Len(), HighestTokenId: vocab.HighestTokenID()}
+	if vocab.HasUnk() {
+		unk := vocab.Unk()
+		info.Unk = &unk
+	}
+	return info
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set(`Content-Type`, `application/json`)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeHTTPError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, httpError{msg})
+}
+
+func isJSON(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get(`Content-Type`), `application/json`)
+}
+
+func isYAML(r *http.Request) bool {
+	contentType := r.Header.Get(`Content-Type`)
+	return strings.HasPrefix(contentType, `application/yaml`) || strings.HasPrefix(contentType, `application/x-yaml`) || strings.HasPrefix(contentType, `text/yaml`)
+}
+
+// Returns the vocabulary from the "vocab" query parameter, or writes the error and returns nil
+func (s *server) httpVocab(w http.ResponseWriter, r *http.Request, idString string) (*sharedVocab, uint32) {
+	id, err := strconv.ParseUint(idString, 10, 32)
+	if err != nil {
+		writeHTTPError(w, http.StatusBadRequest, `Invalid vocabulary ID`)
+		return nil, 0
+	}
+	shared, errCode := s.getVocab(uint32(id))
+	if shared == nil {
+		if errCode == ERROR_ID_IS_UNLOADED {
+			writeHTTPError(w, http.StatusNotFound, `This vocabulary ID has been unloaded`)
+		} else {
+			writeHTTPError(w, http.StatusNotFound, `This vocabulary ID does not exist`)
+		}
+		return nil, 0
+	}
+	return shared, uint32(id)
+}
+
+// Reads the texts from a JSON array of strings, or the body as one text if it's not JSON
+// The texts are UTF-8, also for UTF-16 vocabularies
+func readTexts(r *http.Request) ([]string, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if !isJSON(r) {
+		return []string{string(body)}, nil
+	}
+	var texts []string
+	if err = json.Unmarshal(body, &texts); err != nil {
+		return nil, errors.New(`Request body must be a JSON array of strings`)
+	}
+	return texts, nil
+}
+
+// Counts the tokens of a UTF-8 text, which is converted for UTF-16 vocabularies as by TokenizeString
+func countString(vocab *tokenmonster.Vocab, text string) (int, int, error) {
+	if vocab.Charset() != 2 {
+		return vocab.Count([]byte(text))
+	}
+	tokens, missing, err := vocab.TokenizeString(text)
+	return len(tokens), missing, err
+}
+
+// Serves the REST API
+func (s *server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.StoreInt64(&lastAccess, time.Now().Unix())
+	if maxPayload > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, int64(maxPayload))
+	}
+	path := strings.Trim(r.URL.Path, `/`)
+	if path == `metrics` {
+		s.serveMetrics(w, r)
+		return
+	}
+	parts := strings.Split(path, `/`)
+	if len(parts) < 2 || parts[0] != `v1` {
+		writeHTTPError(w, http.StatusNotFound, `Not found`)
+		return
+	}
+	switch {
+		case len(parts) == 2 && parts[1] == `vocabs`:
+			switch r.Method {
+				case http.MethodGet:
+					s.httpListVocabs(w)
+				case http.MethodPost:
+					s.httpLoadVocab(w, r)
+				default:
+					writeHTTPError(w, http.StatusMethodNotAllowed, `Method not allowed`)
+			}
+		case len(parts) == 3 && parts[1] == `vocabs`:
+			if r.Method != http.MethodDelete && r.Method != http.MethodGet {
+				writeHTTPError(w, http.StatusMethodNotAllowed, `Method not allowed`)
+				return
+			}
+			shared, id := s.httpVocab(w, r, parts[2])
+			if shared == nil {
+				return
+			}
+			if r.Method == http.MethodGet {
+				shared.RLock()
+				info := vocabInfo(id, shared.vocab)
+				shared.RUnlock()
+				writeJSON(w, http.StatusOK, info)
+				return
+			}
+			s.deleteVocab(id)
+			w.WriteHeader(http.StatusNoContent)
+		case len(parts) == 2 && parts[1] == `stats`:
+			writeJSON(w, http.StatusOK, s.stats())
+		case len(parts) == 4 && parts[1] == `vocabs` && parts[3] == `yaml`:
+			s.httpYAML(w, r, parts[2])
+		case len(parts) == 2 && (parts[1] == `tokenize` || parts[1] == `count` || parts[1] == `decode` || parts[1] == `tokens`):
+			if (parts[1] == `tokens` && r.Method != http.MethodGet) || (parts[1] != `tokens` && r.Method != http.MethodPost) {
+				writeHTTPError(w, http.StatusMethodNotAllowed, `Method not allowed`)
+				return
+			}
+			shared, _ := s.httpVocab(w, r, r.URL.Query().Get(`vocab`))
+			if shared == nil {
+				return
+			}
+			start := time.Now()
+			body := &countingReader{ReadCloser: r.Body}
+			r.Body = body
+			cw := &countingResponseWriter{ResponseWriter: w}
+			var ntokens int
+			shared.RLock()
+			defer shared.RUnlock()
+			switch parts[1] {
+				case `tokenize`:
+					ntokens = httpTokenize(cw, r, shared.vocab)
+				case `count`:
+					ntokens = httpCount(cw, r, shared.vocab)
+				case `decode`:
+					httpDecode(cw, r, shared.vocab)
+				case `tokens`:
+					httpTokens(w, shared.vocab)
+					return
+			}
+			shared.stats.record(time.Since(start), body.n, cw.n, ntokens)
+		default:
+			writeHTTPError(w, http.StatusNotFound, `Not found`)
+	}
+}
+
+func (s *server) httpListVocabs(w http.ResponseWriter) {
+	s.mu.RLock()
+	vocabs := make([]*sharedVocab, len(s.vocabs))
+	copy(vocabs, s.vocabs)
+	s.mu.RUnlock()
+	list := make([]httpVocabInfo, 0, len(vocabs))
+	for id, shared := range vocabs {
+		if shared != nil {
+			shared.RLock()
+			list = append(list, vocabInfo(uint32(id), shared.vocab))
+			shared.RUnlock()
+		}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// Loads a vocabulary from {"path": filename}, from a YAML body (as job_type 18), or from the vocabulary file as the body
+func (s *server) httpLoadVocab(w http.ResponseWriter, r *http.Request) {
+	var vocab *tokenmonster.Vocab
+	var err error
+	switch {
+		case isJSON(r):
+			var req httpLoadRequest
+			if err = json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Path) == 0 {
+				writeHTTPError(w, http.StatusBadRequest, `Request body must be {"path": "filename"}`)
+				return
+			}
+			vocab, err = tokenmonster.Load(req.Path)
+		case isYAML(r):
+			var yml []byte
+			if yml, err = io.ReadAll(r.Body); err == nil {
 				vocab = new(tokenmonster.Vocab)
-				err = vocab.PrivateGenerateVocab(data, nil, nil, nil, nil, nil, nil, 0, ``, 0, 0, 0, 0, false)
-				if err != nil {
-					header9[0] = ERROR_YAML_INVALID
-					os.Stdout.Write(header9)
-				} else {
-					if len(deletedVocabs) == 0 {
-						id = uint32(len(vocabs))
-						vocabs = append(vocabs, vocab)
-					} else {
-						id = deletedVocabs[len(deletedVocabs) - 1]
-						deletedVocabs = deletedVocabs[0 : len(deletedVocabs) - 1]
-						vocabs[id] = vocab
-					}
-					header9[0] = statusCode
-					writeUint64(header9[1:], 20)
-					os.Stdout.Write(header9)
-					temp := make([]byte, 20)
-					temp[0] = vocab.Capcode()
-					temp[1] = vocab.Charset()
-					temp[2] = vocab.NormalizationCode()
-					temp[3] = vocab.Mode()
-					writeUint32(temp[4:], uint32(vocab.Len()))
-					writeUint32(temp[8:], id)
-					writeUint32(temp[12:], vocab.Unk())
-					writeUint32(temp[16:], uint32(vocab.HighestTokenID() + 1))
-					os.Stdout.Write(temp)
-				}
+				err = vocab.PrivateGenerateVocab(yml, nil, nil, nil, nil, nil, nil, 0, ``, 0, 0, 0, 0, false)
+			}
+		default:
+			vocab, err = tokenmonster.LoadFrom(r.Body)
+	}
+	if err != nil {
+		writeHTTPError(w, http.StatusBadRequest, `Unable to load vocabulary: ` + err.Error())
+		return
+	}
+	id := s.addVocab(vocab)
+	writeJSON(w, http.StatusCreated, vocabInfo(id, vocab))
+}
 
-			case 19: // Export YAML from vocab
-				statusCode = HEADER_IS_LENGTH
-				if id >= uint32(len(vocabs)) {
-					sendError(ERROR_ID_DOES_NOT_EXIST) // vocab ID does not exist
-					continue
-				}
-				vocab = vocabs[id]
-				if vocab == nil {
-					sendError(ERROR_ID_IS_UNLOADED) // vocab ID already closed
-					continue
-				}
-				w := bytes.NewBuffer(writeBuffer)
-				w.Reset()
-				vocab.ExportYAML(w, data[0] == 1)
-				header9[0] = statusCode
-				writeUint64(header9[1:], uint64(w.Len()))
-				os.Stdout.Write(header9)
-				w.WriteTo(os.Stdout)
-
-			case 20: // Tokenize Count
-				statusCode = HEADER_IS_LENGTH
-				if id >= uint32(len(vocabs)) {
-					sendError(ERROR_ID_DOES_NOT_EXIST)
-					continue
-				}
-				vocab = vocabs[id]
-				if vocab == nil {
-					sendError(ERROR_ID_IS_UNLOADED)
-					continue
-				}
-				numBatches = readUint32(data)
-				data = data[4:]
-				results := make([]workCount, numBatches)
-				if numBatches == 1 {
-					length = readUint64(data)
-					data = data[8:]
-					body := data[0:length]
-					ntokens, _, err := vocab.Count(body)
-					results[0] = workCount{ntokens, err}
-				} else {
-					var wg sync.WaitGroup
-					wg.Add(int(numBatches))
-					for i=0; i<numBatches; i++ {
-						length = readUint64(data)
-						data = data[8:]
-						body := data[0:length]
-						data = data[length:]
-						go func(i uint32, body []byte) {
-							ntokens, _, err := vocab.Count(body)
-							results[i] = workCount{ntokens, err}
-							wg.Done()
-						}(i, body)
-					}
-					wg.Wait()
-				}
-				if results[0].err != nil {
-					statusCode = ERROR_NORMALIZATION_FAILED
-				}
-				length = 4 + (uint64(len(results)) * 8)
-				header13[0] = statusCode
-				writeUint64(header13[1:], length)
-				writeUint32(header13[9:], numBatches)
-				os.Stdout.Write(header13)
-				for i:=0; i<len(results); i++ {
-					writeUint64(header8, uint64(results[i].data))
-					os.Stdout.Write(header8)
-				}
+// GET exports the vocabulary as YAML (as job_type 19), PUT modifies it by YAML (as job_type 17)
+func (s *server) httpYAML(w http.ResponseWriter, r *http.Request, idString string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPut {
+		writeHTTPError(w, http.StatusMethodNotAllowed, `Method not allowed`)
+		return
+	}
+	shared, id := s.httpVocab(w, r, idString)
+	if shared == nil {
+		return
+	}
+	if r.Method == http.MethodGet {
+		orderByScore := r.URL.Query().Get(`order_by_score`) == `true`
+		var buf bytes.Buffer
+		shared.RLock()
+		shared.vocab.ExportYAML(&buf, orderByScore)
+		shared.RUnlock()
+		w.Header().Set(`Content-Type`, `application/yaml`)
+		buf.WriteTo(w)
+		return
+	}
+	yml, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeHTTPError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	shared.Lock()
+	err = shared.vocab.PrivateGenerateVocab(yml, nil, nil, nil, nil, nil, nil, 0, ``, 0, 0, 0, 0, false)
+	info := vocabInfo(id, shared.vocab)
+	shared.Unlock()
+	if err != nil {
+		writeHTTPError(w, http.StatusBadRequest, `YAML is invalid: ` + err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
 
-			default: // Invalid job type
-				header9[0] = ERROR_INVALID_JOB
-				os.Stdout.Write(header9)
+// Returns the number of tokens produced
+func httpTokenize(w http.ResponseWriter, r *http.Request, vocab *tokenmonster.Vocab) (ntokens int) {
+	texts, err := readTexts(r)
+	if err != nil {
+		writeHTTPError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	res := httpTokenizeResponse{make([][]uint32, len(texts)), make([]int, len(texts))}
+	for i, text := range texts {
+		if res.Tokens[i], res.Missing[i], err = vocab.TokenizeString(text); err != nil {
+			writeHTTPError(w, http.StatusBadRequest, `Error normalizing text: ` + err.Error())
+			return 0
 		}
+		if res.Tokens[i] == nil {
+			res.Tokens[i] = []uint32{}
+		}
+		ntokens += len(res.Tokens[i])
+	}
+	writeJSON(w, http.StatusOK, res)
+	return
+}
 
-		os.Stdout.Sync()
-		data = nil
-		lastAccess = time.Now().Unix()
+// Returns the number of tokens counted
+func httpCount(w http.ResponseWriter, r *http.Request, vocab *tokenmonster.Vocab) (ntokens int) {
+	texts, err := readTexts(r)
+	if err != nil {
+		writeHTTPError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	res := httpCountResponse{make([]int, len(texts)), make([]int, len(texts))}
+	for i, text := range texts {
+		if res.Counts[i], res.Missing[i], err = countString(vocab, text); err != nil {
+			writeHTTPError(w, http.StatusBadRequest, `Error normalizing text: ` + err.Error())
+			return 0
+		}
+		ntokens += res.Counts[i]
+	}
+	writeJSON(w, http.StatusOK, res)
+	return
+}
+
+// Decodes a JSON array of arrays of token IDs, a JSON array of token IDs, or serialized tokens as the body
+// The encoding length of serialized tokens is from the "encoding_length" query parameter, otherwise as used by job_type 1
+func httpDecode(w http.ResponseWriter, r *http.Request, vocab *tokenmonster.Vocab) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeHTTPError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var batches [][]uint32
+	if isJSON(r) {
+		if err = json.Unmarshal(body, &batches); err != nil {
+			var tokens []uint32
+			if err = json.Unmarshal(body, &tokens); err != nil {
+				writeHTTPError(w, http.StatusBadRequest, `Request body must be a JSON array of token IDs, or an array of arrays`)
+				return
+			}
+			batches = [][]uint32{tokens}
+		}
+	} else {
+		var encodingLength uint8 = 2
+		if vocab.Len() > 65536 {
+			encodingLength = 4
+		}
+		if v := r.URL.Query().Get(`encoding_length`); len(v) > 0 {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 2 || n > 4 {
+				writeHTTPError(w, http.StatusBadRequest, `encoding_length must be 2, 3 or 4`)
+				return
+			}
+			encodingLength = uint8(n)
+		}
+		if len(body) % int(encodingLength) != 0 {
+			writeHTTPError(w, http.StatusBadRequest, `Body length is not a multiple of the encoding length`)
+			return
+		}
+		batches = [][]uint32{vocab.Deserialize(body, encodingLength)}
 	}
+	res := httpDecodeResponse{make([]string, len(batches))}
+	for i, tokens := range batches {
+		res.Texts[i] = vocab.DecodeToString(tokens)
+	}
+	writeJSON(w, http.StatusOK, res)
+}
 
+func httpTokens(w http.ResponseWriter, vocab *tokenmonster.Vocab) {
+	info := vocab.TokensDetailed()
+	list := make([]httpToken, len(info))
+	for i, v := range info {
+		list[i] = httpToken{Id: v.Id, Token: string(v.Token), Bytes: v.Token, Decoded: string(v.TokenDecoded), Type: v.Type, Score: v.Score}
+	}
+	writeJSON(w, http.StatusOK, list)
 }
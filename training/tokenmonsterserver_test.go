@@ -0,0 +1,103 @@
+package main
+
+// Run with: go test tokenmonsterserver.go tokenmonsterserver_test.go
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+	"net/http"
+	"unicode/utf16"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/binary"
+	"net/http/httptest"
+)
+
+// A YAML vocabulary of the tokens, which are hex encoded as UTF-16 little-endian for a UTF-16 vocabulary
+func testYAML(charset string, tokens []string) string {
+	yml := "charset: \"" + charset + "\"\ninclude-256-bytes: true\ntokens:\n"
+	for _, token := range tokens {
+		if charset == `utf-16` {
+			var b []byte
+			for _, c := range utf16.Encode([]rune(token)) {
+				b = binary.LittleEndian.AppendUint16(b, c)
+			}
+			token = `TokenMonsterHexEncode{` + hex.EncodeToString(b) + `}`
+		}
+		yml += "  - token: \"" + token + "\"\n"
+	}
+	return yml
+}
+
+// Loads a YAML vocabulary over HTTP and returns its ID
+func testLoadVocab(t *testing.T, url string, yml string) uint32 {
+	resp, err := http.Post(url + `/v1/vocabs`, `application/yaml`, bytes.NewBufferString(yml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var info httpVocabInfo
+	if err = json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf(`load vocab: status %d`, resp.StatusCode)
+	}
+	return info.Id
+}
+
+// Posts the request as JSON and decodes the JSON response into res
+func testPost(t *testing.T, url string, req interface{}, res interface{}) {
+	b, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(url, `application/json`, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e httpError
+		json.NewDecoder(resp.Body).Decode(&e)
+		t.Fatalf(`%s: status %d %s`, url, resp.StatusCode, e.Error)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(res); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHTTPRoundTrip(t *testing.T) {
+	srv := new(server)
+	ts := httptest.NewServer(http.HandlerFunc(srv.serveHTTP))
+	defer ts.Close()
+
+	texts := []string{`hello world`, `héllo wörld, 你好`, ``}
+	for _, charset := range []string{`utf-8`, `utf-16`} {
+		id := testLoadVocab(t, ts.URL, testYAML(charset, []string{`hello`, ` world`, ` wörld`}))
+		query := `?vocab=` + strconv.Itoa(int(id))
+
+		var tokenized httpTokenizeResponse
+		testPost(t, ts.URL + `/v1/tokenize` + query, texts, &tokenized)
+		if len(tokenized.Tokens) != len(texts) {
+			t.Fatalf(`%s: tokenize returned %d batches, expected %d`, charset, len(tokenized.Tokens), len(texts))
+		}
+
+		var counted httpCountResponse
+		testPost(t, ts.URL + `/v1/count` + query, texts, &counted)
+		for i, tokens := range tokenized.Tokens {
+			if counted.Counts[i] != len(tokens) {
+				t.Errorf(`%s: count of %q is %d, tokenize returned %d tokens`, charset, texts[i], counted.Counts[i], len(tokens))
+			}
+		}
+
+		var decoded httpDecodeResponse
+		testPost(t, ts.URL + `/v1/decode` + query, tokenized.Tokens, &decoded)
+		for i, text := range texts {
+			if decoded.Texts[i] != text {
+				t.Errorf(`%s: decoded %q, expected %q`, charset, decoded.Texts[i], text)
+			}
+		}
+	}
+}
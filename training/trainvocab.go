@@ -1,17 +1,20 @@
 package main
 
 import (
+	"io"
 	"os"
 	"log"
 	"fmt"
 	"time"
 	"flag"
+	"bufio"
 	"bytes"
 	"errors"
 	"regexp"
 	"unicode"
 	"reflect"
 	"strings"
+	"strconv"
 	"unsafe"
 	"math/rand"
 	"io/ioutil"
@@ -19,6 +22,7 @@ import (
 	"unicode/utf8"
 	"unicode/utf16"
 	"path/filepath"
+	"encoding/gob"
 	"encoding/json"
 	"encoding/binary"
 	"github.com/AlasdairF/Conv"
@@ -28,6 +32,7 @@ import (
 	"github.com/alasdairforsythe/branchless"
 	"github.com/alasdairforsythe/pansearch"
 	"github.com/alasdairforsythe/capcode/go"
+	"github.com/alasdairforsythe/tokenmonster/training/dataset"
 )
 
 const (
@@ -40,6 +45,7 @@ const (
 	apostrophe2    = '’'
 	DOES_NOT_EXIST = 16777215
 	MAXINT = 9223372036854775807
+	checkpointFilename = `checkpoint.dat`
 )
 
 var (
@@ -51,6 +57,8 @@ var (
 	datasetFilename string
 	dictionaryFilename string
 	resultsDir string
+	resumeDir string
+	checkpointEvery int = 10
 	keepTrying int = 1000
 	include256bytes bool
 	includeUTF8bytes bool
@@ -68,6 +76,12 @@ var (
 	hasSpecial bool
 	includeMissingBytes bool
 	normalizer norm.Normalizer
+	textField string = `text`
+	docSeparatorFlag string
+	docSeparator []byte // written after each document of a JSONL dataset
+	docDelimiterFlag string
+	docDelimiterRaw []byte // the document delimiter as it is in the dataset
+	docDelimiter []byte // the normalized document delimiter, tokenization never spans this
 
 	ungreedySuffixes = []string{"'s", "’s"}
 	ungreedySuffixesB [][]byte
@@ -75,6 +89,10 @@ var (
 	specialMap map[string]bool
 
 	remainingTokens_atomic int64
+
+	randSeed int64
+	randState = new(randSource)
+	rnd = rand.New(randState) // only used by the master thread
 )
 
 type resultStruct struct {
@@ -98,6 +116,134 @@ type bestStruct struct {
     filename  string
 }
 
+// A random number source (SplitMix64) whose state can be saved in a checkpoint, which isn't possible with the math/rand source.
+type randSource struct {
+	state uint64
+}
+
+func (s *randSource) Seed(seed int64) {
+	s.state = uint64(seed)
+}
+
+func (s *randSource) Uint64() uint64 {
+	s.state += 0x9E3779B97F4A7C15
+	z := s.state
+	z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+	z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+	return z ^ (z >> 31)
+}
+
+func (s *randSource) Int63() int64 {
+	return int64(s.Uint64() >> 1)
+}
+
+// The state of the master loop, saved in the checkpoint file so that an interrupted run can be resumed where it was.
+// Files are relative to the results directory so that it can be moved.
+type checkpointStruct struct {
+	Args				[]string // the options of the run, not including -resume
+	Seed				int64 // the seed that the data strips were chosen with
+	RandState			uint64
+	UsingCapcode		uint8
+	Charset				uint8
+	Norm				uint8
+	Level				uint8
+	Tokens				[][]byte // in their shuffled order
+	DoubleTokens		[][]byte
+	Double1				[][]byte
+	Double2				[][]byte
+	SingleChars			[][]byte
+	SpecialTokens		[][]byte
+	Best				int
+	Best1percent		int
+	NoNewBest			int
+	UniqueFileNumber	int
+	Interval10			int
+	ZeroRemoved			int
+	ReachedMidway		bool
+	WithinVocabX2		bool
+	ReachedVocab		bool
+	JustReset			bool
+	AddTokens			bool
+	LastIntervalFile	string
+	FinalRunFile		string
+	DoubleVocabFile		string
+	DictsWithin1percent	[]checkpointBest
+	HasMultiDeletes		bool
+	MultiDeletes		[][]byte
+	MultiDeleteCounts	[]int
+	VocabsTried			[]uint64
+}
+
+type checkpointBest struct {
+	Tokens		int
+	Filename	string
+}
+
+// Writes the checkpoint to a temporary file and then renames it, so that there is always a complete checkpoint even if it's interrupted while saving.
+func saveCheckpoint(filename string, c *checkpointStruct) error {
+	fi, err := os.Create(filename + `.tmp`)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(fi)
+	if err = gob.NewEncoder(w).Encode(c); err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = fi.Sync()
+	}
+	if err2 := fi.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(filename + `.tmp`)
+		return err
+	}
+	return os.Rename(filename + `.tmp`, filename)
+}
+
+func loadCheckpoint(filename string) (*checkpointStruct, error) {
+	fi, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+	c := new(checkpointStruct)
+	if err = gob.NewDecoder(bufio.NewReader(fi)).Decode(c); err != nil {
+		return nil, errors.New(filename + ` not valid: ` + err.Error())
+	}
+	return c, nil
+}
+
+// Returns a file in the results directory without the directory, for saving in the checkpoint.
+func relativeFilename(filename string) string {
+	if len(filename) == 0 {
+		return ``
+	}
+	return filepath.Base(filename)
+}
+
+// Returns the options that were set for this run, to be saved in the checkpoint.
+// Filenames are made absolute so that the run can be resumed from any working directory.
+func checkpointArgs() []string {
+	var args []string
+	flag.Visit(func(f *flag.Flag) {
+		value := f.Value.String()
+		switch f.Name {
+			case `resume`:
+				return
+			case `dataset`, `dictionary`, `dictionary2`, `special`, `dir`:
+				if len(value) > 0 {
+					if abs, err := filepath.Abs(value); err == nil {
+						value = abs
+					}
+				}
+		}
+		args = append(args, `-` + f.Name + `=` + value)
+	})
+	return args
+}
+
 type tokenInfo struct {
 	alt		tokenOuter
 }
@@ -409,6 +555,45 @@ func convertStringToUTF16(s string) []byte {
 	*/
 }
 
+// Replaces the first byte of every document delimiter in the normalized dataset with NUL.
+// This way looking ahead at the byte after the end of a document sees the same as after the end of the dataset.
+func markDocuments(data []byte) {
+	if docDelimiter[0] == 0 {
+		return
+	}
+	for i := 0; ; {
+		n := bytes.Index(data[i:], docDelimiter)
+		if n < 0 {
+			break
+		}
+		data[i + n] = 0
+		i += n + len(docDelimiter)
+	}
+	docDelimiter[0] = 0
+}
+
+// Splits the data into the documents between the document delimiters, so that tokenization never spans two documents.
+func splitDocuments(data []byte) [][]byte {
+	if len(docDelimiter) == 0 {
+		return [][]byte{data}
+	}
+	var docs [][]byte
+	for {
+		n := bytes.Index(data, docDelimiter)
+		if n < 0 {
+			break
+		}
+		if n > 0 {
+			docs = append(docs, data[:n])
+		}
+		data = data[n + len(docDelimiter):]
+	}
+	if len(data) > 0 {
+		docs = append(docs, data)
+	}
+	return docs
+}
+
 func saveTokensToFile(filename string, data [][]byte, data2 [][]byte, data3 [][]byte, scores []uint32, datasize int, special [][]byte) error {
 	fi, err := os.Create(filename)
 	if err != nil {
@@ -502,7 +687,7 @@ beginByte
 
 */
 
-func worker(id int, datastrips [][]byte, filedata []byte) {
+func worker(id int, datastrips [][]byte, documents [][]byte) {
 	var i, i1, i2, i3, length, length1, length2, length3, length1b, length2b, length3b int
 	var score1, score2, score3, score1b, score2b, score3b, nWords, branchLength int
 	var index, index1, index2, index3, index1b, index2b, index3b, deleteToken uint32
@@ -914,7 +1099,7 @@ func worker(id int, datastrips [][]byte, filedata []byte) {
 			}
 		}
 		if !asset.fast && reachedMidway && asset.workType == 0 {
-			dataList = [][]byte{filedata}
+			dataList = documents
 			usingFullDataset = true
 		} else {
 			dataList = datastrips
@@ -1324,7 +1509,7 @@ func worker(id int, datastrips [][]byte, filedata []byte) {
 func shuffle(original [][]byte) {
 	var i, j int
 	for i = len(original) - 1; i > 0; i-- {
-		j = rand.Intn(i + 1)
+		j = rnd.Intn(i + 1)
 		original[i], original[j] = original[j], original[i]
 	}
 }
@@ -1347,10 +1532,12 @@ func detectSavedFinal(path string) (uint, bool) {
 func main() {
 
 	flag.IntVar(&vocabSize, "vocab-size", vocabSize, "vocabulary size, e.g. 32000 (required)")
-	flag.StringVar(&datasetFilename, "dataset", datasetFilename, "filename of the dataset plain-text (required)")
+	flag.StringVar(&datasetFilename, "dataset", datasetFilename, "filename of the dataset plain-text, a directory or glob of them, or a YAML or JSON manifest of weighted sources (required)")
 	flag.StringVar(&dictionaryFilename, "dictionary", dictionaryFilename, "filename of the dictionary generated by getalltokens or any of the saved output files from this app (required)")
 	flag.StringVar(&dictionary2, "dictionary2", dictionary2, "a second dictionary that will be merged with the first (optional)")
 	flag.StringVar(&resultsDir, "dir", resultsDir, "directory to save the results within (required)")
+	flag.StringVar(&resumeDir, "resume", resumeDir, "directory of an interrupted run to continue from its checkpoint, with the same options unless they are given again")
+	flag.IntVar(&checkpointEvery, "checkpoint", checkpointEvery, "save a checkpoint to resume from every this many rounds, 0 = never")
 	flag.IntVar(&workers, "workers", workers, "number of worker threads to run, excluding main thread")
 	flag.IntVar(&percentage, "percentage", percentage, "percentage of the dataset given to each worker before midway-target")
 	flag.IntVar(&midwayTarget, "midway-target", midwayTarget, "beneath this the full dataset is used for every worker (default 6x vocab-size)")
@@ -1364,12 +1551,41 @@ func main() {
 	flag.BoolVar(&includeMissingBytes, "include-missing-bytes", includeMissingBytes, "add tokens for any single bytes found in the dataset that are not tokens already (default false)")
 	flag.BoolVar(&excludeOtherBytes, "exclude-other-bytes", excludeOtherBytes, "any single bytes not specifically included will not receive tokens, even if they were in the training dataset (default false)")
 	flag.BoolVar(&fast, "fast", fast, "runs 10x faster but the vocabulary might not be as optimal (default false)")
+	flag.StringVar(&textField, "text-field", textField, "the field containing the text in each record of a JSONL dataset")
+	flag.StringVar(&docSeparatorFlag, "doc-separator", docSeparatorFlag, "what separates the records of a JSONL dataset: boundary = the document delimiter, newline, or paragraph (default boundary)")
+	flag.StringVar(&docDelimiterFlag, "doc-delimiter", docDelimiterFlag, "tokens never span this byte sequence, which separates documents in the dataset: nul, or escaped text such as <|endoftext|> or \\n\\n\\n (default nul between JSONL records, otherwise none)")
 	flag.Parse()
+
+	// Load the checkpoint, and the options of the interrupted run, of which any given now take precedence
+	var resume *checkpointStruct
+	if len(resumeDir) > 0 {
+		var err error
+		if resume, err = loadCheckpoint(filepath.Join(resumeDir, checkpointFilename)); err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to resume:", err)
+			os.Exit(1)
+		}
+		flag.CommandLine.Parse(resume.Args)
+		flag.CommandLine.Parse(os.Args[1:])
+		resultsDir = resumeDir
+	}
+
     flagRequired("vocab", vocabSize)
     flagRequired("dataset", datasetFilename)
     flagRequired("dictionary", dictionaryFilename)
     flagRequired("dir", resultsDir)
 
+	{
+		var err error
+		if docSeparator, err = dataset.ParseSeparator(docSeparatorFlag); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if docDelimiterRaw, err = dataset.ParseDelimiter(docDelimiterFlag); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
 	if excludeOtherBytes && !include256bytes && !include128bytes && !includeASCIIbytes && !includeUTF8bytes &&!includeExtendedbytes {
 		fmt.Fprintln(os.Stderr, "To exclude-other-bytes you need to have included some bytes.")
 		os.Exit(1)
@@ -1394,60 +1610,68 @@ func main() {
 		os.Exit(1)
 	}
 
-	fmt.Println(`Loading`, dictionaryFilename)
+	var tokens [][]byte
+	var err error
+	if resume != nil {
+		fmt.Println(`Resuming from`, filepath.Join(resumeDir, checkpointFilename))
+		usingCapcode, charsetFlag, normalizer.Flag, level = resume.UsingCapcode, resume.Charset, resume.Norm, resume.Level
+	} else {
+		fmt.Println(`Loading`, dictionaryFilename)
 
-	{
-		fileInfo, err := os.Stat(dictionaryFilename)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, "Dictionary file does not exist:", dictionaryFilename)
-			os.Exit(1)
-		}
-		if fileInfo.IsDir() {
-			dirEntries, err := os.ReadDir(dictionaryFilename)
+		{
+			fileInfo, err := os.Stat(dictionaryFilename)
 			if err != nil {
-				fmt.Fprintln(os.Stderr, "Error", err)
+				fmt.Fprintln(os.Stderr, "Dictionary file does not exist:", dictionaryFilename)
 				os.Exit(1)
 			}
-			for _, entry := range dirEntries {
-				if !entry.IsDir() && strings.HasPrefix(entry.Name(), "interval_") {
-					dictionaryFilename = filepath.Join(dictionaryFilename, entry.Name())
-					fmt.Println(`Found interval file:`, dictionaryFilename)
-					break
+			if fileInfo.IsDir() {
+				dirEntries, err := os.ReadDir(dictionaryFilename)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "Error", err)
+					os.Exit(1)
+				}
+				for _, entry := range dirEntries {
+					if !entry.IsDir() && strings.HasPrefix(entry.Name(), "interval_") {
+						dictionaryFilename = filepath.Join(dictionaryFilename, entry.Name())
+						fmt.Println(`Found interval file:`, dictionaryFilename)
+						break
+					}
 				}
 			}
 		}
-	}
 
-	// Load the big dictionary of all the tokens from the dataset
-	var tokens [][]byte
-	var err error
-	usingCapcode, charsetFlag, normalizer.Flag, level, _, tokens, err = loadTokensFromFile(dictionaryFilename)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "Unable to open the file:", dictionaryFilename)
-		os.Exit(1)
-	}
-	// Load the second dictionary (if exists) and remove duplicates
-	if len(dictionary2) > 0 {
-		var tokens2 [][]byte
-		_, _, _, _, _, tokens2, err = loadTokensFromFile(dictionary2)
+		// Load the big dictionary of all the tokens from the dataset
+		usingCapcode, charsetFlag, normalizer.Flag, level, _, tokens, err = loadTokensFromFile(dictionaryFilename)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, "Unable to open the file:", dictionary2)
+			fmt.Fprintln(os.Stderr, "Unable to open the file:", dictionaryFilename)
 			os.Exit(1)
 		}
-		counter := new(pansearch.Counter)
-		for _, b := range tokens {
-			counter.Add(b, 1)
-		}
-		for _, b := range tokens2 {
-			counter.Add(b, 1)
+		// Load the second dictionary (if exists) and remove duplicates
+		if len(dictionary2) > 0 {
+			var tokens2 [][]byte
+			_, _, _, _, _, tokens2, err = loadTokensFromFile(dictionary2)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Unable to open the file:", dictionary2)
+				os.Exit(1)
+			}
+			counter := new(pansearch.Counter)
+			for _, b := range tokens {
+				counter.Add(b, 1)
+			}
+			for _, b := range tokens2 {
+				counter.Add(b, 1)
+			}
+			counter.Build()
+			tokens = counter.Keys()
 		}
-		counter.Build()
-		tokens = counter.Keys()
 	}
 
 	// Parse the special tokens file
 	var specialTokens [][]byte
-	if len(specialTokensFilename) > 0 {
+	if resume != nil {
+		specialTokens = resume.SpecialTokens
+		hasSpecial = len(specialTokens) > 0
+	} else if len(specialTokensFilename) > 0 {
 		log.Println(`Parsing`, specialTokensFilename)
 		file, err := os.Open(specialTokensFilename)
 		if err != nil {
@@ -1568,8 +1792,12 @@ func main() {
 	}
 
 	// Vars
-	rand.Seed(time.Now().UnixNano())
-	var i, i2, to, remainingTokens, best1percent, uniqueFileNumber, noNewBest, interval10, removed, shuffles, zeroRemoved int
+	randSeed = time.Now().UnixNano()
+	if resume != nil {
+		randSeed = resume.Seed // so that each worker gets the same data strips
+	}
+	randState.Seed(randSeed)
+	var i, i2, to, remainingTokens, best1percent, uniqueFileNumber, noNewBest, interval10, removed, shuffles, zeroRemoved, sinceCheckpoint int
 	var exists, hasTokensToRemove, reachedMidway, withinVocabX2, reachedVocab, justReset, addTokens, noMoreVocabs bool
 	var lastIntervalFileName, debugStr, finalRunFilename, doubleVocabFilename string
 	var key []byte
@@ -1612,9 +1840,29 @@ func main() {
 			panic(err)
 		}
 		var numberPart string
+		afterCheckpointDir := filepath.Join(resultsDir, `after_checkpoint`)
 		for _, file := range files {
 			fpath := filepath.Join(resultsDir, file.Name())
-			if strings.HasPrefix(file.Name(), `doublevocab_`) {
+			if resume != nil { // move aside the files saved after the checkpoint, which the resumed run doesn't know about
+				var after bool
+				if strings.HasPrefix(file.Name(), `interval_`) && file.Name() != resume.LastIntervalFile {
+					after = true
+				} else if _, is := detectSavedFinal(file.Name()); is {
+					if n, err := strconv.Atoi(file.Name()[strings.Index(file.Name(), "_")+1 : strings.Index(file.Name(), ".")]); err == nil && n >= resume.UniqueFileNumber {
+						after = true
+					}
+				}
+				if after {
+					if err = os.MkdirAll(afterCheckpointDir, 0755); err == nil {
+						err = os.Rename(fpath, filepath.Join(afterCheckpointDir, file.Name()))
+					}
+					if err != nil {
+						fmt.Printf("Error: %s\n", err)
+						os.Exit(1)
+					}
+					fmt.Println(`Moved`, file.Name(), `to`, afterCheckpointDir, `because it was saved after the checkpoint`)
+				}
+			} else if strings.HasPrefix(file.Name(), `doublevocab_`) {
 				_, _, _, _, _, doubletokens, err = loadTokensFromFile(fpath)
 				if err != nil {
 					fmt.Printf("Error: %s\n", err)
@@ -1657,13 +1905,34 @@ func main() {
 	fmt.Println(`Loading`, datasetFilename)
 	// Load the text & normalize UTF8
 	var filedata []byte
-	filedata, err = ioutil.ReadFile(datasetFilename)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Dataset file does not exist or cannot be opened: " + datasetFilename + "\n")
-		os.Exit(1)
+	{
+		opt := dataset.Options{TextField: textField, Separator: docSeparator, Delimiter: docDelimiterRaw}
+		reader, size, err := opt.Open(datasetFilename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Dataset cannot be opened: %s\n", err.Error())
+			os.Exit(1)
+		}
+		buf := bytes.NewBuffer(make([]byte, 0, size + bytes.MinRead))
+		if _, err = buf.ReadFrom(reader); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading dataset: %s\n", err.Error())
+			os.Exit(1)
+		}
+		if closer, ok := reader.(io.Closer); ok {
+			closer.Close()
+		}
+		filedata = buf.Bytes()
+		docDelimiterRaw = opt.Delimiter
 	}
 	filedata = normalize(filedata)
 	dataLen := len(filedata)
+	if len(docDelimiterRaw) > 0 {
+		if docDelimiter = dataset.NormalizeDelimiter(docDelimiterRaw, normalize); docDelimiter == nil {
+			fmt.Fprintln(os.Stderr, `The document delimiter is empty once normalized`)
+			os.Exit(1)
+		}
+		markDocuments(filedata)
+	}
+	documents := splitDocuments(filedata)
 
 	// Distribute the text randomly but evenly to each worker has x strips each from a different part of filedata
 	if dataLen < 10 * 1024 * 1024 {
@@ -1683,7 +1952,7 @@ func main() {
 		var from int
 		for i=0; i<workers; i++ {
 			data[i] = make([][]byte, strips)
-			from = rand.Intn(offset) // initial position
+			from = rnd.Intn(offset) // initial position
 			for i2=0; i2<strips; i2++ {
 				if from + bytesPerStrip > dataLen {
 					from = (from + bytesPerStrip) - dataLen
@@ -1693,10 +1962,19 @@ func main() {
 			}
 		}
 	}
+	if len(docDelimiter) > 0 { // split the strips at the document delimiters
+		for i=0; i<workers; i++ {
+			var docs [][]byte
+			for _, strip := range data[i] {
+				docs = append(docs, splitDocuments(strip)...)
+			}
+			data[i] = docs
+		}
+	}
 
 	// This section resumes the final run given one of the final outfiles as input
 	// Better to let it resume naturally though
-	if len(tokens) <= vocabSize {
+	if len(tokens) <= vocabSize && resume == nil {
 		if nscore, is := detectSavedFinal(dictionaryFilename); is {
 			best = int(nscore)
 			nscore += nscore / 100
@@ -1807,6 +2085,55 @@ func main() {
 	vocabsTried := make(map[uint64]bool)
 	vocabDiff := len(singleChars) + len(specialTokens) // not including nUnk on purpose
 	vocabSizeEffective := vocabSize - vocabDiff
+
+	// Restore the state of the master loop from the checkpoint
+	if resume != nil {
+		tokens = resume.Tokens
+		doubletokens = resume.DoubleTokens
+		double1 = resume.Double1
+		double2 = resume.Double2
+		singleChars = resume.SingleChars // it may have had missing characters added
+		vocabDiff = len(singleChars) + len(specialTokens)
+		vocabSizeEffective = vocabSize - vocabDiff
+		best = resume.Best
+		best1percent = resume.Best1percent
+		noNewBest = resume.NoNewBest
+		uniqueFileNumber = resume.UniqueFileNumber
+		interval10 = resume.Interval10
+		zeroRemoved = resume.ZeroRemoved
+		reachedMidway = resume.ReachedMidway
+		withinVocabX2 = resume.WithinVocabX2
+		reachedVocab = resume.ReachedVocab
+		justReset = resume.JustReset
+		addTokens = resume.AddTokens
+		if len(resume.LastIntervalFile) > 0 {
+			lastIntervalFileName = filepath.Join(resultsDir, resume.LastIntervalFile)
+		}
+		if len(resume.FinalRunFile) > 0 {
+			finalRunFilename = filepath.Join(resultsDir, resume.FinalRunFile)
+		}
+		if len(resume.DoubleVocabFile) > 0 {
+			doubleVocabFilename = filepath.Join(resultsDir, resume.DoubleVocabFile)
+		}
+		for _, v := range resume.DictsWithin1percent {
+			filename := filepath.Join(resultsDir, v.Filename)
+			if _, err := os.Stat(filename); err == nil { // it may have been deleted by a new best after the checkpoint
+				dictsWithin1percent = append(dictsWithin1percent, bestStruct{v.Tokens, filename})
+			}
+		}
+		if resume.HasMultiDeletes {
+			counterMultiDeletes = new(pansearch.Counter)
+			for i, b := range resume.MultiDeletes {
+				counterMultiDeletes.Add(b, resume.MultiDeleteCounts[i])
+			}
+			counterMultiDeletes.Build()
+		}
+		for _, hash = range resume.VocabsTried {
+			vocabsTried[hash] = true
+		}
+		randState.state = resume.RandState
+		log.Println(`Resumed with`, formatInt(len(tokens) + vocabDiff), `tokens`)
+	}
 	if len(intervalTokens) >= vocabSizeEffective {
 		tokens = intervalTokens // replace regular tokens with interval tokens for resume
 	}
@@ -1823,145 +2150,158 @@ func main() {
 		reachedMidway = true
 	}
 
-	// Launch the worker threads
-	for i=0; i<workers; i++ {
-		go worker(i, data[i], filedata)
-	}
-
-	// Master loop
-	for {
-		select {
-		case result, ok := <- channelResult: // this channel delivers the results
-			if !ok { // channel is closed, never happens
-				break
+	// Processes the result of a vocabulary tested by a worker
+	inFlight := 0 // the number of vocabularies sent to the workers for which the results haven't been processed
+	processResult := func(result resultStruct) {
+		if result.workType == 1 {
+			// workType 1: add tokens, but save for later
+			if len(double1) == 0 {
+				double1 = result.tokensToRemove
+			} else {
+				double2 = result.tokensToRemove
+			}
+		} else {
+			// workType 0: remove tokens
+			// If there are any missing characters, add them to the list
+			if len(result.missing) != 0 {
+				singleChars, i = mergeBytes(singleChars, result.missing)
+				if i > 0 {
+					vocabDiff = len(singleChars) + len(specialTokens)
+					vocabSizeEffective = vocabSize - vocabDiff
+					log.Println(i, `missing character(s) found and added to single byte tokens`)
+				}
 			}
 
-			if result.workType == 1 {
-				// workType 1: add tokens, but save for later
-				if len(double1) == 0 {
-					double1 = result.tokensToRemove
+			// Save all dictionaries within 10% of the best performing one
+			if withinVocabX2 && result.usingFullDataset { // if we're within 2x the vocabSize
+				if result.tokensInText < best {
+					best = result.tokensInText
+					best1percent = best + (best / 100)
+					noNewBest = 0
+					log.Println(`New best score`, formatInt(best))
+					i = 0
+					for _, v := range dictsWithin1percent {
+						if v.tokens > best1percent {
+							os.Remove(v.filename)
+						} else {
+							dictsWithin1percent[i] = v
+							i++
+						}
+					}
+					dictsWithin1percent = dictsWithin1percent[0:i]
 				} else {
-					double2 = result.tokensToRemove
+					noNewBest++
 				}
-			} else {
-				// workType 0: remove tokens
-				// If there are any missing characters, add them to the list
-				if len(result.missing) != 0 {
-					singleChars, i = mergeBytes(singleChars, result.missing)
-					if i > 0 {
-						vocabDiff = len(singleChars) + len(specialTokens)
-						vocabSizeEffective = vocabSize - vocabDiff
-						log.Println(i, `missing character(s) found and added to single byte tokens`)
+				if result.tokensInText < best1percent {
+					filename := resultsDir + conv.String(result.tokensInText) + "_" + conv.String(uniqueFileNumber) + ".tok"
+					uniqueFileNumber++
+					err = saveTokensToFile(filename, result.testVocab.Keys(), nil, nil, result.scores, len(filedata), specialTokens)
+					if err != nil {
+						panic(err)
 					}
+					dictsWithin1percent = append(dictsWithin1percent, bestStruct{result.tokensInText, filename})
 				}
+			}
 
-				// Save all dictionaries within 10% of the best performing one
-				if withinVocabX2 && result.usingFullDataset { // if we're within 2x the vocabSize
-					if result.tokensInText < best {
-						best = result.tokensInText
-						best1percent = best + (best / 100)
-						noNewBest = 0
-						log.Println(`New best score`, formatInt(best))
-						i = 0
-						for _, v := range dictsWithin1percent {
-							if v.tokens > best1percent {
-								os.Remove(v.filename)
-							} else {
-								dictsWithin1percent[i] = v
-								i++
+			if reachedVocab {
+				if noNewBest >= keepTrying {
+					log.Println(`-- FINISHED --`)
+					fmt.Println(`No new best score in`, noNewBest, `runs`)
+					fmt.Println(`Best result tokenized`, formatInt(len(filedata)), `bytes with`, formatInt(best), `tokens`)
+					fmt.Println(`Average`, string(conv.FloatBytes(float64(len(filedata)) / float64(best), 3)), `characters/token`)
+					fmt.Println(`Best result:`)
+					for _, v := range dictsWithin1percent {
+						if v.tokens > best1percent {
+							os.Remove(v.filename) // delete everything not in the top 1%
+						} else {
+							if v.tokens == best {
+								fmt.Println(` `, v.filename) // output the filesnames of all those that are the best, which may be more than 1
 							}
 						}
-						dictsWithin1percent = dictsWithin1percent[0:i]
-					} else {
-						noNewBest++
-					}
-					if result.tokensInText < best1percent {
-						filename := resultsDir + conv.String(result.tokensInText) + "_" + conv.String(uniqueFileNumber) + ".tok"
-						uniqueFileNumber++
-						err = saveTokensToFile(filename, result.testVocab.Keys(), nil, nil, result.scores, len(filedata), specialTokens)
-						if err != nil {
-							panic(err)
-						}
-						dictsWithin1percent = append(dictsWithin1percent, bestStruct{result.tokensInText, filename})
 					}
+					os.Exit(0)
 				}
-
-				if reachedVocab {
-					if noNewBest >= keepTrying {
-						log.Println(`-- FINISHED --`)
-						fmt.Println(`No new best score in`, noNewBest, `runs`)
-						fmt.Println(`Best result tokenized`, formatInt(len(filedata)), `bytes with`, formatInt(best), `tokens`)
-						fmt.Println(`Average`, string(conv.FloatBytes(float64(len(filedata)) / float64(best), 3)), `characters/token`)
-						fmt.Println(`Best result:`)
-						for _, v := range dictsWithin1percent {
-							if v.tokens > best1percent {
-								os.Remove(v.filename) // delete everything not in the top 1%
-							} else {
-								if v.tokens == best {
-									fmt.Println(` `, v.filename) // output the filesnames of all those that are the best, which may be more than 1
-								}
-							}
-						}
-						os.Exit(0)
+				if best != result.tokensInText && len(result.tokensToRemove) > 0 {
+					temp := remainingTokens - vocabSizeEffective
+					switch  {
+						case temp < 25:
+							i2 = 2
+						case temp < 50:
+							i2 = 3
+						case temp < 100:
+							i2 = 4
+						case temp < 200:
+							i2 = 5
+						case temp < 300:
+							i2 = 6
+						case temp < 400:
+							i2 = 8
+						case temp < 500:
+							i2 = 10
+						case temp < 750:
+							i2 = 15
+						case temp < 1000:
+							i2 = 20
+						case temp < 2000:
+							i2 = 30
+						case temp < 2500:
+							i2 = 40
+						case temp < 3000:
+							i2 = 50
+						default:
+							i2 = 100
 					}
-					if best != result.tokensInText && len(result.tokensToRemove) > 0 {
-						temp := remainingTokens - vocabSizeEffective
-						switch  {
-							case temp < 25:
-								i2 = 2
-							case temp < 50:
-								i2 = 3
-							case temp < 100:
-								i2 = 4
-							case temp < 200:
-								i2 = 5
-							case temp < 300:
-								i2 = 6
-							case temp < 400:
-								i2 = 8
-							case temp < 500:
-								i2 = 10
-							case temp < 750:
-								i2 = 15
-							case temp < 1000:
-								i2 = 20
-							case temp < 2000:
-								i2 = 30
-							case temp < 2500:
-								i2 = 40
-							case temp < 3000:
-								i2 = 50
-							default:
-								i2 = 100
-						}
-						if result.tokensInText > best1percent {
-							i2 += 4
-						}
-						if fast {
-							i2 *= 2
-						}
-						i2 = branchless.Min(i2 + zeroRemoved, len(result.tokensToRemove))
-						for i=0; i<i2; i++ {
-							tokensToRemove.Add(result.tokensToRemove[i], 1)
-							if counterMultiDeletes != nil {
-								counterMultiDeletes.Add(result.tokensToRemove[i], remainingTokens - vocabSizeEffective)
-							}
-						}
-						hasTokensToRemove = true
+					if result.tokensInText > best1percent {
+						i2 += 4
+					}
+					if fast {
+						i2 *= 2
 					}
-				} else { // add tokens to remove
-					if best != result.tokensInText {
-						for _, v := range result.tokensToRemove {
-							tokensToRemove.Add(v, 1)
+					i2 = branchless.Min(i2 + zeroRemoved, len(result.tokensToRemove))
+					for i=0; i<i2; i++ {
+						tokensToRemove.Add(result.tokensToRemove[i], 1)
+						if counterMultiDeletes != nil {
+							counterMultiDeletes.Add(result.tokensToRemove[i], remainingTokens - vocabSizeEffective)
 						}
-						hasTokensToRemove = true
 					}
+					hasTokensToRemove = true
+				}
+			} else { // add tokens to remove
+				if best != result.tokensInText {
+					for _, v := range result.tokensToRemove {
+						tokensToRemove.Add(v, 1)
+					}
+					hasTokensToRemove = true
 				}
 			}
+		}
+
+	}
+
+	// Launch the worker threads
+	for i=0; i<workers; i++ {
+		go worker(i, data[i], documents)
+	}
+
+	// Master loop
+	for {
+		select {
+		case result, ok := <- channelResult: // this channel delivers the results
+			if !ok { // channel is closed, never happens
+				break
+			}
+			inFlight--
+			processResult(result)
 
 		default:
 			// no values left in the channel
 			if hasTokensToRemove || remainingTokens < vocabSizeEffective { // if there are any tokens to cull
+				// Before saving a checkpoint wait for the vocabularies the workers are still testing, so that none are lost on resuming
+				if checkpointEvery > 0 && sinceCheckpoint + 1 >= checkpointEvery {
+					for ; inFlight > 0; inFlight-- {
+						processResult(<- channelResult)
+					}
+				}
 				tokensToRemove.Build()
 				remainingTokens = 0
 				removed = 0
@@ -2174,6 +2514,63 @@ func main() {
 						interval10 = 0
 					}
 				}
+				// Save the checkpoint, from which the run can be resumed with -resume
+				if checkpointEvery > 0 {
+					if sinceCheckpoint++; sinceCheckpoint >= checkpointEvery {
+						checkpoint := &checkpointStruct{
+							Args: checkpointArgs(),
+							Seed: randSeed,
+							RandState: randState.state,
+							UsingCapcode: usingCapcode,
+							Charset: charsetFlag,
+							Norm: normalizer.Flag,
+							Level: level,
+							Tokens: tokens,
+							DoubleTokens: doubletokens,
+							Double1: double1,
+							Double2: double2,
+							SingleChars: singleChars,
+							SpecialTokens: specialTokens,
+							Best: best,
+							Best1percent: best1percent,
+							NoNewBest: noNewBest,
+							UniqueFileNumber: uniqueFileNumber,
+							Interval10: interval10,
+							ZeroRemoved: zeroRemoved,
+							ReachedMidway: reachedMidway,
+							WithinVocabX2: withinVocabX2,
+							ReachedVocab: reachedVocab,
+							JustReset: justReset,
+							AddTokens: addTokens,
+							LastIntervalFile: relativeFilename(lastIntervalFileName),
+							FinalRunFile: relativeFilename(finalRunFilename),
+							DoubleVocabFile: relativeFilename(doubleVocabFilename),
+							HasMultiDeletes: counterMultiDeletes != nil,
+						}
+						for _, v := range dictsWithin1percent {
+							checkpoint.DictsWithin1percent = append(checkpoint.DictsWithin1percent, checkpointBest{v.tokens, relativeFilename(v.filename)})
+						}
+						if counterMultiDeletes != nil {
+							counterMultiDeletes.Build()
+							if counterMultiDeletes.Reset() {
+								for eof := false; !eof; {
+									b, count, end := counterMultiDeletes.Next()
+									checkpoint.MultiDeletes = append(checkpoint.MultiDeletes, append([]byte{}, b...))
+									checkpoint.MultiDeleteCounts = append(checkpoint.MultiDeleteCounts, int(count))
+									eof = end
+								}
+							}
+						}
+						checkpoint.VocabsTried = make([]uint64, 0, len(vocabsTried))
+						for hash = range vocabsTried {
+							checkpoint.VocabsTried = append(checkpoint.VocabsTried, hash)
+						}
+						if err = saveCheckpoint(filepath.Join(resultsDir, checkpointFilename), checkpoint); err != nil {
+							log.Println(`Unable to save the checkpoint:`, err)
+						}
+						sinceCheckpoint = 0
+					}
+				}
 			}
 
 			// Check for add tokens
@@ -2211,6 +2608,7 @@ func main() {
 					testVocab2.Build()
 					channelWork <- workStruct{testVocab1, 1, true}
 					channelWork <- workStruct{testVocab2, 1, true}
+					inFlight += 2
 				}
 			}
 
@@ -2281,6 +2679,7 @@ func main() {
 					}
 					if !exists { // if not already seen
 						channelWork <- workStruct{testVocab, 0, false} // send the dictionary to the worker channel
+						inFlight++
 						atLeast1UniqueVocab = true
 						if withinVocabX2 {
 							vocabsTried[hash] = true